@@ -1,62 +1,75 @@
 package main
 
 import (
-	"bufio"
+	"flag"
 	"fmt"
-	"io"
 	"net"
-	"net/http"
+	"time"
 )
 
-const (
-	localAddr  = "localhost:5000"
-	serverAddr = "167.71.227.50:8001"
-)
+const serverAddr = "167.71.227.50:8001"
 
 func main() {
-	conn, err := net.Dial("tcp", serverAddr)
-	if err != nil {
-		fmt.Println("Error connecting to server:", err)
-		return
-	}
-	defer conn.Close()
+	server := flag.String("server", serverAddr, "Tunnel address of the server")
+	rewriteConfig := flag.String("rewrite-config", "", "JSON file with header, path, Location and Set-Cookie rewrite rules")
+	path := flag.String("path", "", "Public path prefix the tunnel is served under, stripped before the local server (like ClientRelayPort.Path)")
+	routesFile := flag.String("routes", "", "JSON routing table sending requests to local servers by path, instead of -local")
+	flag.Parse()
 
-	fmt.Println("Connected to server")
-
-	for {
-		handleRequest(conn)
+	if *routesFile != "" {
+		if *rewriteConfig != "" || *path != "" {
+			fmt.Println("-routes has rewrite rules per route and cannot be combined with -rewrite-config or -path")
+			return
+		}
+		var err error
+		if routes, err = loadRoutes(*routesFile); err != nil {
+			fmt.Println(err)
+			return
+		}
 	}
-}
 
-func handleRequest(conn net.Conn) {
-	// Read request from server
-	req, err := http.ReadRequest(bufio.NewReader(conn))
-	if err != nil {
-		if err != io.EOF {
-			fmt.Println("Error reading request:", err)
+	if *rewriteConfig != "" {
+		var err error
+		if rewrite, err = loadRewrite(*rewriteConfig); err != nil {
+			fmt.Println(err)
+			return
 		}
-		return
 	}
-
-	// Forward request to local server
-	localReq, err := http.NewRequest(req.Method, "http://"+localAddr+req.URL.Path, req.Body)
-	if err != nil {
-		fmt.Println("Error creating local request:", err)
-		return
+	if *path != "" {
+		if rewrite == nil {
+			rewrite = &httpRewrite{}
+		}
+		rewrite.Path = *path
+		if err := rewrite.check(); err != nil {
+			fmt.Println("Invalid -path:", err)
+			return
+		}
 	}
-	localReq.Header = req.Header
 
-	resp, err := http.DefaultClient.Do(localReq)
-	if err != nil {
-		fmt.Println("Error forwarding request:", err)
-		return
+	for {
+		conn, err := dialServer(*server)
+		if err != nil {
+			fmt.Println("Error connecting to server:", err)
+		} else {
+			fmt.Println("Connected to server")
+			session := newMuxSession(conn, true, handleRequest)
+			<-session.done
+			fmt.Println("Disconnected from server:", session.Err())
+		}
+		time.Sleep(5 * time.Second)
 	}
-	defer resp.Body.Close()
+}
 
-	// Send response back to server
-	err = resp.Write(conn)
+// dialServer connects to the server through the proxy the environment sets
+// for it, if any.
+func dialServer(addr string) (net.Conn, error) {
+	proxyURL, err := proxyFromEnv(addr)
 	if err != nil {
-		fmt.Println("Error writing response:", err)
-		return
+		return nil, err
 	}
-}
\ No newline at end of file
+	if proxyURL == nil {
+		return net.Dial("tcp", addr)
+	}
+	fmt.Println("Connecting to server through proxy", proxyURL.Redacted())
+	return dialProxy(proxyURL, addr)
+}
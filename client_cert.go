@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runCertCommand implements "cert init" and "cert enroll".
+func runCertCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s cert init|enroll [flags]", os.Args[0])
+	}
+
+	switch args[0] {
+	case "init":
+		fs := flag.NewFlagSet("cert init", flag.ExitOnError)
+		keyPath := fs.String("key", "client.key", "Path for the new private key")
+		csrPath := fs.String("csr", "client.csr", "Path for the certificate request")
+		name := fs.String("name", "", "Name of this client in the certificate (default the hostname)")
+		force := fs.Bool("force", false, "Overwrite an existing key")
+		fs.Parse(args[1:])
+
+		if *name == "" {
+			*name, _ = os.Hostname()
+		}
+		if _, err := os.Stat(*keyPath); err == nil && !*force {
+			return fmt.Errorf("%s already exists, use -force to replace it", *keyPath)
+		}
+		keyPEM, csrPEM, err := newKeyAndCSR(*name)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(*keyPath, keyPEM, 0600); err != nil {
+			return err
+		}
+		if err := os.WriteFile(*csrPath, csrPEM, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s and %s for %q\n", *keyPath, *csrPath, *name)
+		return nil
+
+	case "enroll":
+		fs := flag.NewFlagSet("cert enroll", flag.ExitOnError)
+		url := fs.String("url", "", "Enrollment endpoint of the relay, e.g. https://relay.example.com:3743")
+		token := fs.String("token", os.Getenv("TUNNEL_ENROLL_TOKEN"), "One-time bootstrap token (default $TUNNEL_ENROLL_TOKEN)")
+		csrPath := fs.String("csr", "client.csr", "Certificate request from cert init")
+		outPath := fs.String("out", "client.crt", "Path for the issued certificate")
+		caPath := fs.String("ca", "", "CA certificate for the relay's TLS (default system roots)")
+		insecure := fs.Bool("insecure", false, "Do not verify the relay's certificate")
+		fs.Parse(args[1:])
+
+		if *url == "" || *token == "" {
+			return fmt.Errorf("-url and -token are required")
+		}
+		csrPEM, err := os.ReadFile(*csrPath)
+		if err != nil {
+			return err
+		}
+		client, err := enrollClient(*caPath, *insecure, nil)
+		if err != nil {
+			return err
+		}
+		chain, err := postCSR(client, strings.TrimSuffix(*url, "/")+"/enroll", *token, csrPEM)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(*outPath, chain, 0644); err != nil {
+			return err
+		}
+		block, _ := pem.Decode(chain)
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s (thumbprint %s, valid until %s)\n", *outPath, certThumbprint(leaf.Raw), leaf.NotAfter.Format(time.RFC3339))
+		return nil
+	}
+	return fmt.Errorf("unknown cert command %q", args[0])
+}
+
+func isPKCS12(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".p12" || ext == ".pfx"
+}
+
+// resolveCertPassword picks the bundle password from -cert-password,
+// -cert-password-file or $TUNNEL_CERT_PASSWORD, in that order. Any of them
+// may be a secret: reference.
+func resolveCertPassword() error {
+	switch {
+	case certPassword != "":
+	case certPassFile != "":
+		data, err := os.ReadFile(certPassFile)
+		if err != nil {
+			return fmt.Errorf("failed to read certificate password: %v", err)
+		}
+		certPassword = strings.TrimRight(string(data), "\r\n")
+	default:
+		certPassword = os.Getenv("TUNNEL_CERT_PASSWORD")
+	}
+	var err error
+	certPassword, err = resolveSecret(certPassword)
+	return err
+}
+
+// loadClientCert loads -cert/-key, or the -cert bundle when it is PKCS#12.
+func loadClientCert() (tls.Certificate, error) {
+	if isPKCS12(clientCertPath) {
+		return loadPKCS12(clientCertPath, certPassword)
+	}
+	return loadKeyPair(clientCertPath, clientKeyPath)
+}
+
+func newKeyAndCSR(name string) (keyPEM, csrPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: name}}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}), nil
+}
+
+func enrollClient(caPath string, insecure bool, cert *tls.Certificate) (*http.Client, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caPath != "" {
+		data, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read relay CA: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", caPath)
+		}
+	}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	return &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{
+		TLSClientConfig: config,
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			return relayProxy(req.URL.Host)
+		},
+	}}, nil
+}
+
+// postCSR sends a PEM certificate request and returns the issued chain.
+func postCSR(client *http.Client, url, token string, csrPEM []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(csrPEM))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/pkcs10")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// renewClientCert keeps -cert/-key fresh: once less than a third of the
+// lifetime is left, it sends a CSR for a new key, authenticated with the
+// current certificate. Sessions load the files on connect and pick up the
+// new pair.
+func renewClientCert(url, caPath string, insecure bool) {
+	for {
+		wait, err := renewIfDue(url, caPath, insecure)
+		if err != nil {
+			log.Printf("Certificate renewal failed: %v", err)
+			wait = 10 * time.Minute
+		}
+		time.Sleep(wait)
+	}
+}
+
+func renewIfDue(url, caPath string, insecure bool) (time.Duration, error) {
+	cert, err := loadClientCert()
+	if err != nil {
+		return 0, fmt.Errorf("failed to load client certificate: %v", err)
+	}
+	leaf := cert.Leaf
+	renewAt := leaf.NotAfter.Add(-leaf.NotAfter.Sub(leaf.NotBefore) / 3)
+	if wait := time.Until(renewAt); wait > 0 {
+		return min(wait, time.Hour), nil
+	}
+
+	log.Printf("Renewing client certificate, it expires at %s", leaf.NotAfter.Format(time.RFC3339))
+	client, err := enrollClient(caPath, insecure, &cert)
+	if err != nil {
+		return 0, err
+	}
+	keyPEM, csrPEM, err := newKeyAndCSR(leaf.Subject.CommonName)
+	if err != nil {
+		return 0, err
+	}
+	chain, err := postCSR(client, strings.TrimSuffix(url, "/")+"/renew", "", csrPEM)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tls.X509KeyPair(chain, keyPEM); err != nil {
+		return 0, fmt.Errorf("relay returned an unusable certificate: %v", err)
+	}
+
+	// A session starting between the two renames fails once and retries
+	if err := writeFileAtomic(clientKeyPath, keyPEM, 0600); err != nil {
+		return 0, err
+	}
+	if err := writeFileAtomic(clientCertPath, chain, 0644); err != nil {
+		return 0, err
+	}
+	block, _ := pem.Decode(chain)
+	renewed, _ := x509.ParseCertificate(block.Bytes)
+	log.Printf("Client certificate renewed (thumbprint %s, valid until %s)", certThumbprint(renewed.Raw), renewed.NotAfter.Format(time.RFC3339))
+	return time.Hour, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+type relayStatus struct {
+	Address  string `json:"address"`
+	RttMs    int64  `json:"rttMs"`
+	Failures int    `json:"failures"`
+	Current  bool   `json:"current"`
+}
+
+type clientStatus struct {
+	Mode           string          `json:"mode"`
+	Relay          string          `json:"relay"`
+	PublicAddress  string          `json:"publicAddress,omitempty"`
+	ConnectedSince *time.Time      `json:"connectedSince,omitempty"`
+	Relays         []relayStatus   `json:"relays"`
+	ExpiresAt      *time.Time      `json:"expiresAt,omitempty"`
+	Remaining      string          `json:"remaining,omitempty"`
+	ScheduleActive *bool           `json:"scheduleActive,omitempty"`
+	NextWindow     *time.Time      `json:"nextWindow,omitempty"`
+	Pool           *poolStatus     `json:"pool,omitempty"`
+	Forwards       []forwardStatus `json:"forwards,omitempty"`
+}
+
+type poolStatus struct {
+	Starting int `json:"starting"`
+	Idle     int `json:"idle"`
+	Active   int `json:"active"`
+	Min      int `json:"min"`
+	Max      int `json:"max"`
+}
+
+func currentStatus() clientStatus {
+	status := clientStatus{Mode: "tcp"}
+	if useHTTP {
+		status.Mode = "http"
+	}
+	if len(remoteForwards) > 0 || len(localForwards) > 0 {
+		status.Mode = "forward"
+		status.Forwards = forwardStatuses()
+	}
+
+	if deadline := tunnelDeadline(); !deadline.IsZero() {
+		status.ExpiresAt = &deadline
+		status.Remaining = time.Until(deadline).Round(time.Second).String()
+	}
+	if len(tunnelSchedule) > 0 {
+		_, active := windowEnd(tunnelSchedule, time.Now())
+		status.ScheduleActive = &active
+		if !active {
+			next := nextWindowStart(tunnelSchedule, time.Now())
+			status.NextWindow = &next
+		}
+	}
+
+	if warmPool != nil {
+		status.Pool = warmPool.status()
+	}
+
+	relays.mu.Lock()
+	defer relays.mu.Unlock()
+
+	for i, r := range relays.relays {
+		status.Relays = append(status.Relays, relayStatus{
+			Address:  r.addr,
+			RttMs:    r.rtt.Milliseconds(),
+			Failures: r.failures,
+			Current:  i == relays.current,
+		})
+	}
+	status.Relay = relays.relays[relays.current].addr
+	status.PublicAddress = relays.publicAddr
+	if !relays.connectedAt.IsZero() && relays.publicAddr != "" {
+		connectedAt := relays.connectedAt
+		status.ConnectedSince = &connectedAt
+	}
+	return status
+}
+
+func startControlAPI(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(currentStatus())
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+
+	log.Printf("Control API listening on %s", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Control API error: %v", err)
+		}
+	}()
+}
+
+// writeMetrics writes the traffic counters in the Prometheus text format.
+func writeMetrics(w io.Writer) {
+	s := tunnelShaper
+	fmt.Fprintln(w, "# TYPE ssl_tunnel_bytes_total counter")
+	fmt.Fprintf(w, "ssl_tunnel_bytes_total{direction=\"up\"} %d\n", s.bytesUp.Load())
+	fmt.Fprintf(w, "ssl_tunnel_bytes_total{direction=\"down\"} %d\n", s.bytesDown.Load())
+	fmt.Fprintln(w, "# TYPE ssl_tunnel_rate_limit_bytes gauge")
+	fmt.Fprintf(w, "ssl_tunnel_rate_limit_bytes{direction=\"up\"} %d\n", s.upRate)
+	fmt.Fprintf(w, "ssl_tunnel_rate_limit_bytes{direction=\"down\"} %d\n", s.downRate)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintln(w, "# TYPE ssl_tunnel_streams gauge")
+	fmt.Fprintf(w, "ssl_tunnel_streams %d\n", len(s.conns))
+	fmt.Fprintln(w, "# TYPE ssl_tunnel_quota_used_bytes gauge")
+	fmt.Fprintf(w, "ssl_tunnel_quota_used_bytes{period=\"daily\"} %d\n", s.state.DayBytes)
+	fmt.Fprintf(w, "ssl_tunnel_quota_used_bytes{period=\"monthly\"} %d\n", s.state.MonthBytes)
+	fmt.Fprintln(w, "# TYPE ssl_tunnel_quota_limit_bytes gauge")
+	fmt.Fprintf(w, "ssl_tunnel_quota_limit_bytes{period=\"daily\"} %d\n", s.dailyQuota)
+	fmt.Fprintf(w, "ssl_tunnel_quota_limit_bytes{period=\"monthly\"} %d\n", s.monthlyQuota)
+	exhausted := 0
+	if s.exhausted {
+		exhausted = 1
+	}
+	fmt.Fprintln(w, "# TYPE ssl_tunnel_quota_exhausted gauge")
+	fmt.Fprintf(w, "ssl_tunnel_quota_exhausted %d\n", exhausted)
+	writeCompressionMetrics(w)
+}
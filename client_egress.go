@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const egressIdleTimeout = 5 * time.Minute
+
+// runEgress keeps sessions idle at the relay for its proxy service to use
+// this client as an exit. It never returns.
+func runEgress(sessions int) {
+	log.Printf("Offering %d egress sessions to the relay", sessions)
+	for i := 0; i < sessions; i++ {
+		go func() {
+			for {
+				waitUntilActive()
+				if err := serveEgressSession(); err != nil {
+					log.Printf("Egress error: %v", err)
+					time.Sleep(5 * time.Second)
+				}
+			}
+		}()
+	}
+	select {}
+}
+
+func serveEgressSession() error {
+	cert, err := loadClientCert()
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+	}
+
+	relayAddr := relays.currentAddr()
+	conn, err := dialRelay(relayAddr, config)
+	if err != nil {
+		relays.reportFailure(relayAddr)
+		return fmt.Errorf("failed to connect to server %s: %v", relayAddr, err)
+	}
+	defer conn.Close()
+	defer closeAtDeadline(conn)()
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	hello := &tunnelHello{Egress: true}
+	if compress {
+		hello.Compression = []string{compressionDeflate}
+	}
+	if err := writeHello(conn, hello); err != nil {
+		relays.reportFailure(relayAddr)
+		return fmt.Errorf("failed to send hello: %v", err)
+	}
+	_, reply, err := readReply(conn)
+	if err != nil {
+		relays.reportFailure(relayAddr)
+		return err
+	}
+	if reply.Error != "" {
+		return fmt.Errorf("relay refused egress session: %s", reply.Error)
+	}
+	relays.reportSuccess(relayAddr, relayAddr)
+
+	// Idle until the relay hands this session to a proxy user. Reconnecting
+	// after a while keeps NAT state fresh.
+	conn.SetDeadline(time.Now().Add(egressIdleTimeout))
+	cmd := &egressCommand{}
+	if err := readJSONFrame(conn, cmd); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil
+		}
+		return fmt.Errorf("failed to read egress command: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if cmd.Command != egressConnect {
+		writeJSONFrame(conn, &tunnelReply{Error: fmt.Sprintf("unsupported command %d", cmd.Command), Code: "failed"})
+		return nil
+	}
+
+	dest := net.JoinHostPort(cmd.Host, strconv.Itoa(cmd.Port))
+	target, reply := dialEgressDestination(cmd.Host, cmd.Port)
+	if target == nil {
+		if reply.Code == "denied" {
+			log.Printf("Egress session %s to %s not allowed", cmd.SessionId, dest)
+		}
+		return writeJSONFrame(conn, reply)
+	}
+	defer target.Close()
+
+	if err := writeJSONFrame(conn, &tunnelReply{}); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	log.Printf("Egress session %s -> %s", cmd.SessionId, dest)
+	stream := tunnelShaper.shapeConn(conn)
+	defer stream.Close()
+	if reply.Compression != "" {
+		// Compression starts after the command exchange
+		stream = newCompressedConn(stream)
+	}
+	proxyStreams(target, target, stream)
+	return nil
+}
+
+// dialEgressDestination resolves host and dials the first address
+// -proxy-allow permits. Exits are often routers, so their own loopback,
+// link-local and private networks (the admin UI, the site LAN) are only
+// reached when the list names them; "*" does not.
+func dialEgressDestination(host string, port int) (net.Conn, *tunnelReply) {
+	dest := net.JoinHostPort(host, strconv.Itoa(port))
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, &tunnelReply{Error: err.Error(), Code: "unreachable"}
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		if isInternalIP(ip) {
+			if !proxyAllowed.allowsNamed(host, ip, port) {
+				continue
+			}
+		} else if len(proxyAllowed) > 0 && !proxyAllowed.allows(host, ip, port) {
+			continue
+		}
+		// Dial the address that was checked rather than resolving again
+		target, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)), 10*time.Second)
+		if err == nil {
+			return target, &tunnelReply{}
+		}
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		return nil, &tunnelReply{Error: "destination " + dest + " not allowed", Code: "denied"}
+	}
+	code := "unreachable"
+	if errors.Is(lastErr, syscall.ECONNREFUSED) {
+		code = "refused"
+	}
+	return nil, &tunnelReply{Error: lastErr.Error(), Code: code}
+}
+
+func isInternalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// TestEgressInternalDestinations checks that an exit only reaches its own
+// loopback and private networks when -proxy-allow names them.
+func TestEgressInternalDestinations(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	defer func(saved destAllowList) { proxyAllowed = saved }(proxyAllowed)
+	for _, tc := range []struct {
+		allow string
+		host  string
+		want  bool
+	}{
+		{"", "127.0.0.1", false},
+		{"", "localhost", false},
+		{"*", "127.0.0.1", false},
+		{"*:*", "localhost", false},
+		{"127.0.0.1", "127.0.0.1", true},
+		{"127.0.0.0/8", "localhost", true},
+		{"localhost", "localhost", true},
+		{"10.0.0.0/8", "127.0.0.1", false},
+	} {
+		if proxyAllowed, err = parseDestAllowList(tc.allow); err != nil {
+			t.Fatal(err)
+		}
+		target, reply := dialEgressDestination(tc.host, port)
+		if target != nil {
+			target.Close()
+		}
+		if got := target != nil; got != tc.want {
+			t.Errorf("-proxy-allow %q, %s: connected %v (%s), want %v", tc.allow, tc.host, got, reply.Error, tc.want)
+		}
+		if !tc.want && reply.Code != "denied" {
+			t.Errorf("-proxy-allow %q, %s: code %q, want denied", tc.allow, tc.host, reply.Code)
+		}
+	}
+}
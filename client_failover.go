@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type relay struct {
+	addr     string
+	rtt      time.Duration
+	failures int
+}
+
+type relayList struct {
+	mu            sync.Mutex
+	relays        []*relay
+	current       int
+	failoverAfter int
+	publicAddr    string
+	connectedAt   time.Time
+}
+
+func parseRelays(list, defaultPort string) ([]*relay, error) {
+	var relays []*relay
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(entry); err != nil {
+			entry = net.JoinHostPort(entry, defaultPort)
+		}
+		relays = append(relays, &relay{addr: entry})
+	}
+	if len(relays) == 0 {
+		return nil, fmt.Errorf("no relays in %q", list)
+	}
+	return relays, nil
+}
+
+func newRelayList(relays []*relay, selection string, failoverAfter int) (*relayList, error) {
+	rl := &relayList{relays: relays, failoverAfter: failoverAfter}
+
+	switch selection {
+	case "order":
+	case "latency":
+		rl.probeAll()
+		sort.SliceStable(rl.relays, func(i, j int) bool {
+			return rl.relays[i].rtt < rl.relays[j].rtt
+		})
+	default:
+		return nil, fmt.Errorf("unknown relay selection %q", selection)
+	}
+
+	for i, r := range rl.relays {
+		log.Printf("Relay %d: %s (rtt %v)", i+1, r.addr, r.rtt)
+	}
+	return rl, nil
+}
+
+// pingRelay measures the TCP connect time, much like ClientRelayPort.Ping,
+// through the relay proxy if there is one.
+func pingRelay(addr string) (time.Duration, error) {
+	start := time.Now()
+	conn, err := dialRelayConn(addr)
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+	return time.Since(start), nil
+}
+
+func (rl *relayList) probeAll() {
+	var wg sync.WaitGroup
+	for _, r := range rl.relays {
+		wg.Add(1)
+		go func(r *relay) {
+			defer wg.Done()
+			rtt, err := pingRelay(r.addr)
+			if err != nil {
+				log.Printf("Relay %s unreachable: %v", r.addr, err)
+				// Unreachable relays sort last
+				rtt = time.Hour
+			}
+			r.rtt = rtt
+		}(r)
+	}
+	wg.Wait()
+}
+
+func (rl *relayList) currentAddr() string {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.relays[rl.current].addr
+}
+
+func (rl *relayList) reportFailure(addr string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	r := rl.relays[rl.current]
+	if r.addr != addr {
+		return
+	}
+	r.failures++
+	rl.publicAddr = ""
+	if r.failures < rl.failoverAfter || len(rl.relays) == 1 {
+		return
+	}
+
+	r.failures = 0
+	rl.current = (rl.current + 1) % len(rl.relays)
+	log.Printf("Relay %s failed %d handshakes in a row, failing over to %s", addr, rl.failoverAfter, rl.relays[rl.current].addr)
+}
+
+func (rl *relayList) reportSuccess(addr, publicAddr string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	r := rl.relays[rl.current]
+	if r.addr != addr {
+		return
+	}
+	r.failures = 0
+	if rl.publicAddr != publicAddr {
+		rl.publicAddr = publicAddr
+		rl.connectedAt = time.Now()
+		log.Printf("Public address: %s (via relay %s)", publicAddr, addr)
+	}
+}
+
+// failBack periodically checks whether a relay earlier in the list is
+// reachable again and, if so, makes it current for the next connection.
+func (rl *relayList) failBack(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		rl.mu.Lock()
+		candidates := append([]*relay(nil), rl.relays[:rl.current]...)
+		rl.mu.Unlock()
+
+		for i, r := range candidates {
+			rtt, err := pingRelay(r.addr)
+			if err != nil {
+				continue
+			}
+
+			rl.mu.Lock()
+			if i < rl.current {
+				log.Printf("Relay %s is reachable again (rtt %v), failing back", r.addr, rtt)
+				r.rtt = rtt
+				r.failures = 0
+				rl.current = i
+			}
+			rl.mu.Unlock()
+			break
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// settingFileServer mirrors Models/FileServer/SettingFileServer.
+type settingFileServer struct {
+	Title                   string
+	CanEveryoneReadAccess   bool
+	CanEveryoneWriteAccess  bool
+	CanEveryoneDeleteAccess bool
+	UserRoleFileServer      map[string]userRoleFileServer
+}
+
+// userRoleFileServer mirrors Models/FileServer/UserRoleFileServer.
+type userRoleFileServer struct {
+	CanReadAccess   bool
+	CanWriteAccess  bool
+	CanDeleteAccess bool
+	Password        string
+}
+
+// fileInfoDetail mirrors Models/FileInfoDetail.
+type fileInfoDetail struct {
+	Name          string
+	Path          string
+	Length        string
+	IsFolder      bool
+	LastWriteTime time.Time
+}
+
+// fileServerIndexModel mirrors the parts of Models/FileServerIndexModel the
+// listing page needs.
+type fileServerIndexModel struct {
+	Title              string
+	UserName           string
+	PathDic            [][2]string
+	FileInfoDetailList []fileInfoDetail
+	CanCreateNewFolder bool
+	CanUploadFile      bool
+	CanRename          bool
+	CanDelete          bool
+}
+
+type fileServer struct {
+	root     *os.Root
+	settings settingFileServer
+}
+
+var fileServerIndex = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Title}}</title>
+<style>body{font-family:sans-serif;margin:2em}td{padding:2px 12px}form{display:inline}</style></head>
+<body><h1>{{.Title}}</h1>
+<p>{{range $i, $p := .PathDic}}{{if $i}} / {{end}}<a href="{{index $p 0}}/">{{index $p 1}}</a>{{end}}{{if .UserName}} &mdash; signed in as {{.UserName}}{{end}}</p>
+<table><tr><th align="left">Name</th><th align="right">Size</th><th align="left">Modified</th><th></th></tr>
+{{range .FileInfoDetailList}}<tr><td><a href="{{.Path}}">{{.Name}}{{if .IsFolder}}/{{end}}</a></td><td align="right">{{.Length}}</td><td>{{.LastWriteTime.Format "2006-01-02 15:04"}}</td><td>
+{{if $.CanRename}}<form method="post" action="{{.Path}}?action=rename"><input name="to" placeholder="new name"><button>Rename</button></form>{{end}}
+{{if $.CanDelete}}<form method="post" action="{{.Path}}?action=delete"><button>Delete</button></form>{{end}}
+</td></tr>{{end}}
+</table>
+{{if .CanUploadFile}}<p><form method="post" action="?action=upload" enctype="multipart/form-data"><input type="file" name="file" multiple><button>Upload</button></form></p>{{end}}
+{{if .CanCreateNewFolder}}<p><form method="post" action="?action=mkdir"><input name="name" placeholder="folder name"><button>New folder</button></form></p>{{end}}
+</body></html>
+`))
+
+// loadFileServerSettings reads the file server config. Nothing is
+// readable without a password unless the config says so, since the
+// directory ends up on the relay's public port.
+func loadFileServerSettings(path string) (settingFileServer, error) {
+	settings := settingFileServer{Title: "Tunlify File Server"}
+	if path == "" {
+		return settings, fmt.Errorf("-serve-dir needs -file-server-config with users, or CanEveryoneReadAccess to publish the directory without a password")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return settings, fmt.Errorf("failed to read file server config: %v", err)
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return settings, fmt.Errorf("failed to parse file server config: %v", err)
+	}
+	return settings, nil
+}
+
+// startFileServer serves dir on a loopback port and returns its address,
+// so that it can be used as a local target like any other backend.
+func startFileServer(dir string, settings settingFileServer) (string, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %v", dir, err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("failed to start file server: %v", err)
+	}
+
+	// Browsers send cached basic auth credentials along with forms posted
+	// from other sites, so rename, delete, mkdir and upload must come from
+	// the file server's own pages
+	server := http.NewCrossOriginProtection().Handler(&fileServer{root: root, settings: settings})
+	go func() {
+		if err := http.Serve(listener, server); err != nil {
+			log.Printf("File server error: %v", err)
+		}
+	}()
+	log.Printf("Serving %s on %s", dir, listener.Addr())
+	return listener.Addr().String(), nil
+}
+
+// permissions returns the user name and the read/write/delete rights of the
+// request, falling back to the everyone rights for anonymous requests.
+func (s *fileServer) permissions(r *http.Request) (string, bool, bool, bool, bool) {
+	read := s.settings.CanEveryoneReadAccess
+	write := s.settings.CanEveryoneWriteAccess
+	del := s.settings.CanEveryoneDeleteAccess
+
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return "", read, write, del, true
+	}
+	role, found := s.settings.UserRoleFileServer[user]
+	if !found || subtle.ConstantTimeCompare([]byte(pass), []byte(role.Password)) != 1 {
+		return user, false, false, false, false
+	}
+	return user, read || role.CanReadAccess, write || role.CanWriteAccess, del || role.CanDeleteAccess, true
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, canRead, canWrite, canDelete, authOK := s.permissions(r)
+	if !authOK {
+		log.Printf("File server: wrong password for %q from %s", user, r.RemoteAddr)
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "."
+	}
+
+	var allowed bool
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		allowed = canRead
+	case r.Method == http.MethodDelete || r.URL.Query().Get("action") == "delete":
+		allowed = canDelete
+	default:
+		allowed = canWrite
+	}
+	if !allowed {
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+s.settings.Title+`"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var err error
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		err = s.serveGet(w, r, name, user, canWrite, canDelete)
+	case r.Method == http.MethodDelete:
+		err = s.remove(name)
+	case r.Method == http.MethodPost:
+		switch r.URL.Query().Get("action") {
+		case "upload":
+			err = s.upload(r, name)
+		case "mkdir":
+			err = s.mkdir(name, r.FormValue("name"))
+		case "rename":
+			err = s.rename(name, r.FormValue("to"))
+		case "delete":
+			err = s.remove(name)
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			status = http.StatusNotFound
+		case errors.Is(err, fs.ErrExist):
+			status = http.StatusConflict
+		case errors.Is(err, fs.ErrPermission):
+			status = http.StatusForbidden
+		case errors.Is(err, fs.ErrInvalid):
+			status = http.StatusBadRequest
+		}
+		log.Printf("File server: %s %s: %v", r.Method, r.URL.Path, err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		log.Printf("File server: %s %s by %q", r.URL.Query().Get("action"), r.URL.Path, user)
+		// Back to the folder listing after a form post
+		back := path.Dir(strings.TrimSuffix(r.URL.Path, "/"))
+		if r.URL.Query().Get("action") == "upload" || r.URL.Query().Get("action") == "mkdir" {
+			back = r.URL.Path
+		}
+		http.Redirect(w, r, strings.TrimSuffix(back, "/")+"/", http.StatusSeeOther)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *fileServer) serveGet(w http.ResponseWriter, r *http.Request, name, user string, canWrite, canDelete bool) error {
+	f, err := s.root.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		// ServeContent takes care of Range and conditional requests
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", info.Name()))
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+		return nil
+	}
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return nil
+	}
+
+	entries, err := f.ReadDir(-1)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir() != entries[j].IsDir() {
+			return entries[i].IsDir()
+		}
+		return strings.ToLower(entries[i].Name()) < strings.ToLower(entries[j].Name())
+	})
+
+	dir := "/" + strings.TrimPrefix(path.Clean("/"+name), "/")
+	model := fileServerIndexModel{
+		Title:              s.settings.Title,
+		UserName:           user,
+		PathDic:            pathDic(dir),
+		CanCreateNewFolder: canWrite,
+		CanUploadFile:      canWrite,
+		CanRename:          canWrite,
+		CanDelete:          canDelete,
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		detail := fileInfoDetail{
+			Name:          entry.Name(),
+			Path:          path.Join(dir, entry.Name()),
+			IsFolder:      entry.IsDir(),
+			LastWriteTime: info.ModTime(),
+		}
+		if entry.IsDir() {
+			detail.Path += "/"
+		} else {
+			detail.Length = dataLengthCalc(info.Size())
+		}
+		model.FileInfoDetailList = append(model.FileInfoDetailList, detail)
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(model)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return fileServerIndex.Execute(w, model)
+}
+
+func (s *fileServer) upload(r *http.Request, dir string) error {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			continue
+		}
+
+		name, err := childName(dir, part.FileName())
+		if err != nil {
+			return err
+		}
+		f, err := s.root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, part)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *fileServer) mkdir(dir, name string) error {
+	child, err := childName(dir, name)
+	if err != nil {
+		return err
+	}
+	return s.root.Mkdir(child, 0755)
+}
+
+func (s *fileServer) rename(name, to string) error {
+	if name == "." {
+		return fs.ErrPermission
+	}
+	target, err := childName(path.Dir(name), to)
+	if err != nil {
+		return err
+	}
+	return s.root.Rename(name, target)
+}
+
+func (s *fileServer) remove(name string) error {
+	if name == "." {
+		return fs.ErrPermission
+	}
+	return s.root.RemoveAll(name)
+}
+
+// childName joins a user-supplied file name onto dir, refusing anything that
+// is not a single path element.
+func childName(dir, name string) (string, error) {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "" || name == "." || name == ".." || name == "/" {
+		return "", fmt.Errorf("invalid name %q: %w", name, fs.ErrInvalid)
+	}
+	return path.Join(dir, name), nil
+}
+
+// pathDic builds the breadcrumb list like FileServerIndexModel.SetPathDic.
+func pathDic(dir string) [][2]string {
+	crumbs := [][2]string{{"", "Home"}}
+	current := ""
+	for _, part := range strings.Split(dir, "/") {
+		if part == "" {
+			continue
+		}
+		current += "/" + part
+		crumbs = append(crumbs, [2]string{current, part})
+	}
+	return crumbs
+}
+
+// dataLengthCalc formats a size like FileInfoDetail.DataLengthCalc.
+func dataLengthCalc(length int64) string {
+	if length <= 0 {
+		return ""
+	}
+	units := []string{"Byte", "Kb", "Mb", "Gb", "Tb"}
+	num := float64(length)
+	index := 0
+	for num > 1024 && index < len(units)-1 {
+		num /= 1024
+		index++
+	}
+	return fmt.Sprintf("%.2f %s", num, units[index])
+}
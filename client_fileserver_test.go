@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestFileServerCrossOrigin checks that forms posted from other sites are
+// refused while the file server's own pages still work.
+func TestFileServerCrossOrigin(t *testing.T) {
+	dir := t.TempDir()
+	addr, err := startFileServer(dir, settingFileServer{CanEveryoneReadAccess: true, CanEveryoneWriteAccess: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		header  string
+		value   string
+		allowed bool
+	}{
+		{"cross-site", "Sec-Fetch-Site", "cross-site", false},
+		{"other-origin", "Origin", "https://attacker.example", false},
+		{"same-origin", "Sec-Fetch-Site", "same-origin", true},
+		{"same-host", "Origin", "http://" + addr, true},
+	} {
+		form := url.Values{"name": {tc.name}}
+		req, _ := http.NewRequest(http.MethodPost, "http://"+addr+"/?action=mkdir", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(tc.header, tc.value)
+		resp, err := (&http.Client{CheckRedirect: noFollow}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		_, statErr := os.Stat(filepath.Join(dir, tc.name))
+		if created := statErr == nil; created != tc.allowed {
+			t.Errorf("%s: %s, folder created %v, want %v", tc.name, resp.Status, created, tc.allowed)
+		}
+		if !tc.allowed && resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: %s, want 403", tc.name, resp.Status)
+		}
+	}
+}
+
+func noFollow(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// forwardFlags collects repeated -R and -L values.
+type forwardFlags []string
+
+func (f *forwardFlags) String() string { return strings.Join(*f, ",") }
+
+func (f *forwardFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// remoteForward exposes target on a public port of the relay (-R).
+type remoteForward struct {
+	port    int
+	target  string
+	public  string
+	streams atomic.Int64
+	peers   atomic.Int64
+}
+
+// localForward listens on listen and reaches dest on the relay's network
+// (-L).
+type localForward struct {
+	listen  string
+	dest    string
+	streams atomic.Int64
+	// direct is the session to the peer serving dest, when there is a
+	// direct path, and peerForward the index of its remote forward.
+	direct      *muxSession
+	peerForward int
+}
+
+var (
+	remoteForwardSpecs forwardFlags
+	localForwardSpecs  forwardFlags
+	remoteForwards     []*remoteForward
+	localForwards      []*localForward
+
+	forwardMu      sync.Mutex
+	forwardSession *muxSession
+)
+
+// parseRemoteForward parses "public:local", where public is a port (0 for
+// any) and local is a port on 127.0.0.1 or host:port.
+func parseRemoteForward(spec string) (*remoteForward, error) {
+	public, local, ok := strings.Cut(spec, ":")
+	port, err := strconv.Atoi(public)
+	if !ok || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid -R %q, expected public:local, e.g. 8080:3000 or 0:db.lan:5432", spec)
+	}
+	if _, err := strconv.Atoi(local); err == nil {
+		local = net.JoinHostPort("127.0.0.1", local)
+	}
+	if _, _, err := net.SplitHostPort(local); err != nil {
+		return nil, fmt.Errorf("invalid -R %q: %v", spec, err)
+	}
+	return &remoteForward{port: port, target: local}, nil
+}
+
+// parseLocalForward parses "[bind:]localport:relayhost:port" like ssh -L;
+// the listener binds to 127.0.0.1 unless bind is given.
+func parseLocalForward(spec string) (*localForward, error) {
+	bind, rest := "127.0.0.1", spec
+	first, after, _ := strings.Cut(spec, ":")
+	if _, err := strconv.Atoi(first); err != nil {
+		bind, rest = strings.Trim(first, "[]"), after
+	}
+	localPort, dest, _ := strings.Cut(rest, ":")
+	port, err := strconv.Atoi(localPort)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid -L %q, expected [bind:]localport:relayhost:port", spec)
+	}
+	if _, _, err := net.SplitHostPort(dest); err != nil {
+		return nil, fmt.Errorf("invalid -L %q: %v", spec, err)
+	}
+	return &localForward{listen: net.JoinHostPort(bind, localPort), dest: dest}, nil
+}
+
+// runForwards serves the -R and -L forwards over one multiplexed session
+// per relay connection and never returns.
+func runForwards() {
+	for _, f := range localForwards {
+		listener, err := net.Listen("tcp", f.listen)
+		if err != nil {
+			log.Fatalf("Failed to listen for -L %s: %v", f.listen, err)
+		}
+		log.Printf("Local forward %s -> %s on the relay", f.listen, f.dest)
+		go f.serve(listener)
+	}
+
+	for {
+		waitUntilActive()
+		tunnelShaper.waitForQuota()
+		if err := runForwardSession(); err != nil {
+			log.Printf("Error: %v\n", err)
+			log.Println("Retrying in 5 seconds...")
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+func runForwardSession() error {
+	cert, err := loadClientCert()
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+	}
+	relayAddr := relays.currentAddr()
+	conn, err := dialRelay(relayAddr, config)
+	if err != nil {
+		relays.reportFailure(relayAddr)
+		return fmt.Errorf("failed to connect to server %s: %v", relayAddr, err)
+	}
+	defer conn.Close()
+	defer closeAtDeadline(conn)()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	hello := deadlineHello()
+	if hello == nil {
+		hello = &tunnelHello{}
+	}
+	hello.Mux = true
+	for _, f := range remoteForwards {
+		hello.Remote = append(hello.Remote, f.port)
+	}
+	if p2pEnabled {
+		hello.P2P = p2pCandidates()
+	}
+	if compress {
+		hello.Compression = []string{compressionDeflate}
+	}
+	if err := writeHello(conn, hello); err != nil {
+		relays.reportFailure(relayAddr)
+		return fmt.Errorf("failed to send hello: %v", err)
+	}
+	_, reply, err := readReply(conn)
+	if err != nil {
+		relays.reportFailure(relayAddr)
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	if reply.Error != "" {
+		return fmt.Errorf("server refused tunnel: %s", reply.Error)
+	}
+	if len(reply.Ports) != len(remoteForwards) {
+		return fmt.Errorf("server granted %d of %d remote forwards", len(reply.Ports), len(remoteForwards))
+	}
+
+	relayHost, _, _ := net.SplitHostPort(relayAddr)
+	publicAddr := relayAddr
+	forwardMu.Lock()
+	for i, f := range remoteForwards {
+		f.public = net.JoinHostPort(relayHost, strconv.Itoa(reply.Ports[i]))
+		log.Printf("Remote forward %s -> %s", f.public, f.target)
+		if i == 0 {
+			publicAddr = f.public
+		}
+	}
+	forwardMu.Unlock()
+	relays.reportSuccess(relayAddr, publicAddr)
+
+	session := tunnelShaper.shapeConn(conn)
+	if reply.Compression != "" {
+		log.Printf("Using %s compression", reply.Compression)
+		session = newCompressedConn(session)
+	}
+	mux := newMuxSession(session, true, serveRemoteStream)
+	defer mux.Close()
+	log.Printf("Multiplexed session to %s established", relayAddr)
+
+	forwardMu.Lock()
+	forwardSession = mux
+	forwardMu.Unlock()
+	defer func() {
+		forwardMu.Lock()
+		if forwardSession == mux {
+			forwardSession = nil
+		}
+		forwardMu.Unlock()
+	}()
+
+	if p2pEnabled {
+		for _, f := range localForwards {
+			go f.rendezvous(mux)
+		}
+	}
+
+	<-mux.done
+	return fmt.Errorf("multiplexed session ended: %v", mux.Err())
+}
+
+// serveRemoteStream dials the local target of the remote forward a public
+// connection arrived on.
+func serveRemoteStream(st *muxStream, payload []byte) {
+	var req muxRequest
+	if err := json.Unmarshal(payload, &req); err != nil || req.Forward < 0 || req.Forward >= len(remoteForwards) {
+		st.reject("invalid stream request")
+		return
+	}
+	if req.Peer != nil {
+		if !p2pEnabled || req.Peer.Forward < 0 || req.Peer.Forward >= len(remoteForwards) {
+			st.reject("direct connections are disabled")
+			return
+		}
+		st.accept()
+		st.Close()
+		servePeer(req.Peer)
+		return
+	}
+	f := remoteForwards[req.Forward]
+	localConn, err := net.DialTimeout("tcp", f.target, 10*time.Second)
+	if err != nil {
+		log.Printf("Failed to connect to local endpoint %s: %v", f.target, err)
+		st.reject(err.Error())
+		return
+	}
+	defer localConn.Close()
+	defer st.Close()
+	if err := st.accept(); err != nil {
+		return
+	}
+
+	f.streams.Add(1)
+	defer f.streams.Add(-1)
+	log.Printf("Public connection from %s forwarded to %s", req.Remote, f.target)
+	toLocal, toServer, err := pipeConns(localConn, st)
+	log.Printf("Connection from %s closed. Server -> Local: %d bytes, Local -> Server: %d bytes\n", req.Remote, toLocal, toServer)
+	if err != nil {
+		log.Printf("Forwarding error: %v", err)
+	}
+}
+
+func (f *localForward) serve(listener net.Listener) {
+	for {
+		localConn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Error accepting connection on %s: %v\n", f.listen, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go f.forward(localConn)
+	}
+}
+
+func (f *localForward) forward(localConn net.Conn) {
+	defer localConn.Close()
+
+	forwardMu.Lock()
+	mux, direct := forwardSession, f.direct
+	forwardMu.Unlock()
+
+	var st *muxStream
+	var err error
+	if direct != nil {
+		req, _ := json.Marshal(&muxRequest{Forward: f.peerForward, Remote: localConn.RemoteAddr().String()})
+		if st, err = direct.open(req); err != nil {
+			log.Printf("Direct path for %s failed, using the relay: %v", f.dest, err)
+		}
+	}
+	if st == nil && mux == nil {
+		log.Printf("No session to the relay for %s -> %s", localConn.RemoteAddr(), f.dest)
+		return
+	}
+	if st == nil {
+		req, _ := json.Marshal(&muxRequest{Connect: f.dest})
+		st, err = mux.open(req)
+	}
+	if err != nil {
+		log.Printf("Local forward %s -> %s failed: %v", localConn.RemoteAddr(), f.dest, err)
+		return
+	}
+	defer st.Close()
+
+	f.streams.Add(1)
+	defer f.streams.Add(-1)
+	log.Printf("Local forward %s -> %s", localConn.RemoteAddr(), f.dest)
+	if _, _, err := pipeConns(localConn, st); err != nil {
+		log.Printf("Forwarding error: %v", err)
+	}
+}
+
+type forwardStatus struct {
+	Type    string `json:"type"`
+	Listen  string `json:"listen,omitempty"`
+	Target  string `json:"target"`
+	Streams int64  `json:"streams"`
+	// Path is "relay" or "direct <peer address>" for local forwards.
+	Path string `json:"path,omitempty"`
+	// Peers counts the direct sessions of other clients to a remote
+	// forward.
+	Peers int64 `json:"peers,omitempty"`
+}
+
+func forwardStatuses() []forwardStatus {
+	forwardMu.Lock()
+	defer forwardMu.Unlock()
+	var list []forwardStatus
+	for _, f := range remoteForwards {
+		list = append(list, forwardStatus{Type: "remote", Listen: f.public, Target: f.target, Streams: f.streams.Load(), Peers: f.peers.Load()})
+	}
+	for _, f := range localForwards {
+		path := "relay"
+		if f.direct != nil {
+			path = "direct " + f.direct.conn.RemoteAddr().String()
+		}
+		list = append(list, forwardStatus{Type: "local", Listen: f.listen, Target: f.dest, Streams: f.streams.Load(), Path: path})
+	}
+	return list
+}
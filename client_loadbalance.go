@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	healthFailThreshold = 3
+	healthRiseThreshold = 2
+)
+
+// loadBalance mirrors Models/LoadBalance so the same JSON can be reused.
+type loadBalance struct {
+	Id                         int
+	Ip                         string
+	Port                       int
+	Percent                    float64
+	IsHealthy                  *bool
+	EnableHealthy              bool
+	EnableHealthyCheckWithHttp bool
+	Url                        string
+	IsSslStream                *bool
+}
+
+type backend struct {
+	cfg     loadBalance
+	addr    string
+	weight  float64
+	healthy atomic.Bool
+	active  atomic.Int64
+
+	// Guarded by backendPool.mu
+	current float64
+	fails   int
+	rises   int
+}
+
+type backendPool struct {
+	strategy string
+	backends []*backend
+
+	mu   sync.Mutex
+	next int
+}
+
+type backendConn struct {
+	net.Conn
+	b    *backend
+	once sync.Once
+}
+
+func (c *backendConn) Close() error {
+	c.once.Do(func() { c.b.active.Add(-1) })
+	return c.Conn.Close()
+}
+
+func (c *backendConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func loadBackends(path string) ([]loadBalance, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read load balance config: %v", err)
+	}
+
+	var members []loadBalance
+	if err := json.Unmarshal(data, &members); err != nil {
+		return nil, fmt.Errorf("failed to parse load balance config: %v", err)
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("load balance config %s has no members", path)
+	}
+	return members, nil
+}
+
+func newBackendPool(strategy string, members []loadBalance) (*backendPool, error) {
+	switch strategy {
+	case "round-robin", "weighted", "least-conn", "source-hash":
+	default:
+		return nil, fmt.Errorf("unknown load balance strategy %q", strategy)
+	}
+
+	p := &backendPool{strategy: strategy}
+	for _, m := range members {
+		if m.Ip == "" || m.Port <= 0 || m.Port > 65535 {
+			return nil, fmt.Errorf("invalid load balance member %d: %s:%d", m.Id, m.Ip, m.Port)
+		}
+		b := &backend{
+			cfg:    m,
+			addr:   net.JoinHostPort(m.Ip, strconv.Itoa(m.Port)),
+			weight: m.Percent,
+		}
+		if b.weight <= 0 {
+			b.weight = 1
+		}
+		b.healthy.Store(m.IsHealthy == nil || *m.IsHealthy)
+		p.backends = append(p.backends, b)
+	}
+	return p, nil
+}
+
+func (p *backendPool) candidates() []*backend {
+	var healthy []*backend
+	for _, b := range p.backends {
+		if b.healthy.Load() {
+			healthy = append(healthy, b)
+		}
+	}
+	if len(healthy) == 0 {
+		// Better to try everything than to refuse every connection
+		return p.backends
+	}
+	return healthy
+}
+
+func (p *backendPool) pick(source string, exclude map[*backend]bool) *backend {
+	var list []*backend
+	for _, b := range p.candidates() {
+		if !exclude[b] {
+			list = append(list, b)
+		}
+	}
+	if len(list) == 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch p.strategy {
+	case "weighted":
+		// Smooth weighted round-robin, as used by nginx
+		var best *backend
+		total := 0.0
+		for _, b := range list {
+			b.current += b.weight
+			total += b.weight
+			if best == nil || b.current > best.current {
+				best = b
+			}
+		}
+		best.current -= total
+		return best
+	case "least-conn":
+		best := list[0]
+		for _, b := range list[1:] {
+			if float64(b.active.Load())/b.weight < float64(best.active.Load())/best.weight {
+				best = b
+			}
+		}
+		return best
+	case "source-hash":
+		if source != "" {
+			host, _, err := net.SplitHostPort(source)
+			if err != nil {
+				host = source
+			}
+			h := fnv.New32a()
+			h.Write([]byte(host))
+			return list[int(h.Sum32()%uint32(len(list)))]
+		}
+		// Without a source address there is nothing to hash, fall back to round-robin
+	}
+
+	b := list[p.next%len(list)]
+	p.next++
+	return b
+}
+
+func (p *backendPool) dial(source string) (net.Conn, error) {
+	tried := make(map[*backend]bool)
+	var lastErr error
+	for {
+		b := p.pick(source, tried)
+		if b == nil {
+			if lastErr == nil {
+				lastErr = fmt.Errorf("no backends configured")
+			}
+			return nil, lastErr
+		}
+		tried[b] = true
+
+		conn, err := b.dial()
+		if err != nil {
+			log.Printf("Backend %s dial failed: %v", b.addr, err)
+			// Only health checks can bring an ejected backend back, so
+			// backends without them are never ejected for failed dials
+			if b.cfg.EnableHealthy {
+				p.markResult(b, false)
+			}
+			lastErr = fmt.Errorf("failed to connect to backend %s: %v", b.addr, err)
+			continue
+		}
+		p.markResult(b, true)
+		b.active.Add(1)
+		return &backendConn{Conn: conn, b: b}, nil
+	}
+}
+
+func (b *backend) dial() (net.Conn, error) {
+	if b.cfg.IsSslStream != nil && *b.cfg.IsSslStream {
+		return tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", b.addr, localTLSFor(b.cfg.Ip))
+	}
+	return net.DialTimeout("tcp", b.addr, 10*time.Second)
+}
+
+func (p *backendPool) markResult(b *backend, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ok {
+		b.fails = 0
+		b.rises++
+		if !b.healthy.Load() && b.rises >= healthRiseThreshold {
+			b.healthy.Store(true)
+			log.Printf("Backend %s is healthy again", b.addr)
+		}
+		return
+	}
+
+	b.rises = 0
+	b.fails++
+	if b.healthy.Load() && b.fails >= healthFailThreshold {
+		b.healthy.Store(false)
+		log.Printf("Backend %s ejected after %d failed checks", b.addr, b.fails)
+	}
+}
+
+func (p *backendPool) runHealthChecks(interval time.Duration) {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: localTLS,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, b := range p.backends {
+			if !b.cfg.EnableHealthy {
+				continue
+			}
+			go func(b *backend) {
+				err := b.check(client)
+				if err != nil {
+					log.Printf("Health check for %s failed: %v", b.addr, err)
+				}
+				p.markResult(b, err == nil)
+			}(b)
+		}
+		<-ticker.C
+	}
+}
+
+func (b *backend) check(client *http.Client) error {
+	if !b.cfg.EnableHealthyCheckWithHttp {
+		conn, err := net.DialTimeout("tcp", b.addr, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	url := b.cfg.Url
+	if url == "" {
+		scheme := "http"
+		if b.cfg.IsSslStream != nil && *b.cfg.IsSslStream {
+			scheme = "https"
+		}
+		url = scheme + "://" + b.addr + "/"
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return nil
+}
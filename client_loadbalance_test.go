@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// TestPassiveEjection checks that failed dials only eject members with
+// health checks, which can bring them back.
+func TestPassiveEjection(t *testing.T) {
+	live, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	go func() {
+		for {
+			conn, err := live.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	livePort := live.Addr().(*net.TCPAddr).Port
+	deadPort := closed.Addr().(*net.TCPAddr).Port
+
+	for _, checked := range []bool{false, true} {
+		pool, err := newBackendPool("round-robin", []loadBalance{
+			{Ip: "127.0.0.1", Port: deadPort, EnableHealthy: checked},
+			{Ip: "127.0.0.1", Port: livePort},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2*healthFailThreshold; i++ {
+			conn, err := pool.dial("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+		}
+		if got := pool.backends[0].healthy.Load(); got == checked {
+			t.Errorf("EnableHealthy %v: failing member healthy %v, want %v", checked, got, !checked)
+		}
+		if !pool.backends[1].healthy.Load() {
+			t.Errorf("EnableHealthy %v: working member ejected", checked)
+		}
+	}
+}
+
+// TestLeastConnWeights checks that least-conn compares connections per
+// unit of weight, including weights below 0.01.
+func TestLeastConnWeights(t *testing.T) {
+	pool, err := newBackendPool("least-conn", []loadBalance{
+		{Ip: "127.0.0.1", Port: 1, Percent: 0.005},
+		{Ip: "127.0.0.1", Port: 2, Percent: 0.001},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1/0.005 = 200 against 0/0.001 = 0, then 1/0.005 = 200 against 1/0.001 = 1000
+	pool.backends[0].active.Store(1)
+	if got := pool.pick("", nil); got != pool.backends[1] {
+		t.Errorf("picked %s with the idle member available", got.addr)
+	}
+	pool.backends[1].active.Store(1)
+	if got := pool.pick("", nil); got != pool.backends[0] {
+		t.Errorf("picked %s, want the member with five times the weight", got.addr)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// localTLS is the base config for local targets with IsSslStream set. Its
+// ServerName is filled per target unless -local-sni overrides it.
+var localTLS = &tls.Config{}
+
+// buildLocalTLS sets up verification of local targets: a custom CA, SPKI
+// pins ("sha256/<base64>" as in curl's --pinnedpubkey), both, or none when
+// insecure. Without any of them the system roots are used.
+func buildLocalTLS(sni, caFile, pinList, certFile, keyFile string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{ServerName: sni}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read local CA: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := loadKeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load local client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	pins := make(map[string]bool)
+	for _, pin := range strings.Split(pinList, ",") {
+		if pin = strings.TrimSpace(pin); pin == "" {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %q, expected sha256/<base64>", pin)
+		}
+		pins[string(sum)] = true
+	}
+
+	switch {
+	case insecure:
+		if caFile != "" || len(pins) > 0 {
+			return nil, fmt.Errorf("-local-insecure cannot be combined with -local-ca or -local-pin")
+		}
+		config.InsecureSkipVerify = true
+	case len(pins) > 0 && caFile == "":
+		// The pin is the trust anchor, the chain is not checked
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = verifyPins(pins)
+	case len(pins) > 0:
+		config.VerifyConnection = verifyPins(pins)
+	}
+	return config, nil
+}
+
+func verifyPins(pins map[string]bool) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("local target sent no certificate")
+		}
+		leaf := cs.PeerCertificates[0]
+		sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+		if !pins[string(sum[:])] {
+			return fmt.Errorf("certificate of local target does not match any pin (sha256/%s)", base64.StdEncoding.EncodeToString(sum[:]))
+		}
+		return nil
+	}
+}
+
+// localTLSFor returns the config for dialing host.
+func localTLSFor(host string) *tls.Config {
+	config := localTLS.Clone()
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	return config
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	punchTimeout = 10 * time.Second
+	p2pRetry     = 5 * time.Minute
+)
+
+var (
+	p2pEnabled  bool
+	p2pPort     int
+	p2pListener net.Listener
+
+	punchMu sync.Mutex
+	// punches holds the connections accepted for each pending peerOffer.
+	punches      = make(map[string]chan net.Conn)
+	peerSessions = make(map[string]*peerSession)
+)
+
+// startP2P opens the listener peers connect to. Sessions to the relay are
+// dialed from the same port (see reusePort).
+func startP2P() error {
+	lc := net.ListenConfig{Control: reusePort}
+	listener, err := lc.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", p2pPort))
+	if err != nil {
+		return fmt.Errorf("failed to listen for direct connections: %v", err)
+	}
+	p2pListener = listener
+	p2pPort = listener.Addr().(*net.TCPAddr).Port
+	log.Printf("Accepting direct connections on port %d", p2pPort)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("Error accepting direct connection: %v", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			go acceptPunch(conn)
+		}
+	}()
+	return nil
+}
+
+// soReusePort is SO_REUSEPORT, which the syscall package does not define on
+// every platform; 0 where there is none.
+func soReusePort() int {
+	switch {
+	case runtime.GOOS == "linux" && strings.HasPrefix(runtime.GOARCH, "mips"):
+		return 0x200
+	case runtime.GOOS == "linux":
+		return 0xf
+	case runtime.GOOS == "darwin" || strings.HasSuffix(runtime.GOOS, "bsd"):
+		return 0x200
+	}
+	return 0
+}
+
+// reusePort lets the relay session and the hole-punching dials share the
+// port of the direct-path listener, so that the relay observes the NAT
+// mapping peers have to connect to. Without SO_REUSEPORT the relay session
+// falls back to another port and peers only use the listener's addresses.
+func reusePort(network, address string, c syscall.RawConn) error {
+	opt := soReusePort()
+	if opt == 0 {
+		return nil
+	}
+	var err error
+	c.Control(func(fd uintptr) {
+		if err = setsockopt(syscall.SetsockoptInt, fd, syscall.SO_REUSEADDR); err == nil {
+			err = setsockopt(syscall.SetsockoptInt, fd, opt)
+		}
+	})
+	return err
+}
+
+// setsockopt enables a socket option; fd is an int on Unix and a Handle on
+// Windows.
+func setsockopt[FD ~int | ~uintptr](set func(FD, int, int, int) error, fd uintptr, opt int) error {
+	return set(FD(fd), syscall.SOL_SOCKET, opt, 1)
+}
+
+// p2pCandidates lists the addresses of this host's interfaces with the
+// direct-path port.
+func p2pCandidates() []string {
+	var candidates []string
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		prefix, ok := addr.(*net.IPNet)
+		if !ok || prefix.IP.IsLoopback() || prefix.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		candidates = append(candidates, net.JoinHostPort(prefix.IP.String(), strconv.Itoa(p2pPort)))
+	}
+	if len(candidates) == 0 {
+		candidates = append(candidates, net.JoinHostPort("127.0.0.1", strconv.Itoa(p2pPort)))
+	}
+	return candidates
+}
+
+// dialRelayTCP dials the relay from the direct-path port when there is
+// one, falling back to any port if that one is still tied up.
+func dialRelayTCP(relayAddr string) (net.Conn, error) {
+	if p2pListener != nil {
+		d := &net.Dialer{Timeout: 10 * time.Second, LocalAddr: &net.TCPAddr{Port: p2pPort}, Control: reusePort}
+		if conn, err := d.Dial("tcp", relayAddr); err == nil {
+			return conn, nil
+		}
+	}
+	return net.DialTimeout("tcp", relayAddr, 10*time.Second)
+}
+
+func acceptPunch(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(punchTimeout))
+	token := make([]byte, 32)
+	if _, err := io.ReadFull(conn, token); err != nil {
+		conn.Close()
+		return
+	}
+	punchMu.Lock()
+	ch := punches[string(token)]
+	punchMu.Unlock()
+	if ch == nil {
+		log.Printf("Direct connection from %s has no pending rendezvous", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if _, err := conn.Write(token); err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case ch <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// dialPunch keeps dialing candidate from the direct-path port until the
+// peer answers with the token or ctx ends. When both sides dial at once, their SYNs open the
+// NAT mappings for each other (TCP simultaneous open).
+func dialPunch(ctx context.Context, candidate, token string, ch chan net.Conn) {
+	d := &net.Dialer{Timeout: 2 * time.Second, LocalAddr: &net.TCPAddr{Port: p2pPort}, Control: reusePort}
+	for ctx.Err() == nil {
+		conn, err := d.DialContext(ctx, "tcp", candidate)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(300 * time.Millisecond):
+			}
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(punchTimeout))
+		answer := make([]byte, len(token))
+		if _, err := io.WriteString(conn, token); err == nil {
+			if _, err = io.ReadFull(conn, answer); err == nil && string(answer) == token {
+				select {
+				case ch <- conn:
+				default:
+					conn.Close()
+				}
+				return
+			}
+		}
+		// The peer may not have its offer yet
+		conn.Close()
+		select {
+		case <-ctx.Done():
+		case <-time.After(300 * time.Millisecond):
+		}
+	}
+}
+
+// punch connects to the peer of offer and returns the authenticated TLS
+// connection.
+func punch(offer *peerOffer) (net.Conn, error) {
+	if len(offer.Token) != 32 {
+		return nil, errors.New("invalid rendezvous token")
+	}
+	ch := make(chan net.Conn, len(offer.Candidates)+4)
+	punchMu.Lock()
+	punches[offer.Token] = ch
+	punchMu.Unlock()
+	defer func() {
+		punchMu.Lock()
+		delete(punches, offer.Token)
+		punchMu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), punchTimeout)
+	defer cancel()
+	for _, candidate := range offer.Candidates {
+		go dialPunch(ctx, candidate, offer.Token, ch)
+	}
+
+	// The dialing side picks one of the connections that got through and
+	// marks it with a byte; the other side waits for that mark.
+	var conn net.Conn
+	if offer.Dial {
+		select {
+		case conn = <-ch:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("peer unreachable at %v", offer.Candidates)
+		}
+		if _, err := conn.Write([]byte{1}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	} else {
+		chosen := make(chan net.Conn, 1)
+	wait:
+		for {
+			select {
+			case c := <-ch:
+				go func() {
+					if _, err := io.ReadFull(c, make([]byte, 1)); err != nil {
+						c.Close()
+						return
+					}
+					chosen <- c
+				}()
+			case conn = <-chosen:
+				break wait
+			case <-ctx.Done():
+				return nil, fmt.Errorf("peer unreachable at %v", offer.Candidates)
+			}
+		}
+	}
+	go func() {
+		// Connections that also got through are not needed
+		time.Sleep(punchTimeout)
+		for {
+			select {
+			case extra := <-ch:
+				extra.Close()
+			default:
+				return
+			}
+		}
+	}()
+
+	cert, err := loadClientCert()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to load client certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+		ClientAuth:         tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || certThumbprint(rawCerts[0]) != offer.Thumbprint {
+				return errors.New("peer certificate does not match the rendezvous")
+			}
+			return nil
+		},
+	}
+	var tlsConn *tls.Conn
+	if offer.Dial {
+		tlsConn = tls.Client(conn, config)
+	} else {
+		tlsConn = tls.Server(conn, config)
+	}
+	conn.SetDeadline(time.Now().Add(punchTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with peer %s failed: %v", conn.RemoteAddr(), err)
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// rendezvous keeps trying to move f to a direct path while relay is up.
+// Connections use the relay meanwhile and whenever the direct path is lost.
+func (f *localForward) rendezvous(relay *muxSession) {
+	for {
+		if err := f.tryDirect(relay); err != nil {
+			log.Printf("No direct path for %s -> %s, using the relay: %v", f.listen, f.dest, err)
+		}
+		select {
+		case <-relay.done:
+			return
+		case <-time.After(p2pRetry):
+		}
+	}
+}
+
+func (f *localForward) tryDirect(relay *muxSession) error {
+	req, _ := json.Marshal(&muxRequest{Rendezvous: f.dest})
+	st, err := relay.open(req)
+	if err != nil {
+		return err
+	}
+	var offer peerOffer
+	err = readJSONFrame(st, &offer)
+	st.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read rendezvous: %v", err)
+	}
+
+	direct, created, err := connectPeer(&offer, false)
+	if err != nil {
+		return err
+	}
+	if created {
+		log.Printf("Direct path to %s", direct.conn.RemoteAddr())
+	}
+	log.Printf("Using the direct path for %s -> %s", f.listen, f.dest)
+
+	forwardMu.Lock()
+	f.direct, f.peerForward = direct, offer.Forward
+	forwardMu.Unlock()
+	<-direct.done
+	forwardMu.Lock()
+	f.direct = nil
+	forwardMu.Unlock()
+	log.Printf("Direct path for %s -> %s closed: %v", f.listen, f.dest, direct.Err())
+	return nil
+}
+
+// servePeer answers a peerOffer from the relay: the peer may open streams
+// to the offered remote forward on its direct session.
+func servePeer(offer *peerOffer) {
+	f := remoteForwards[offer.Forward]
+	direct, created, err := connectPeer(offer, true)
+	if err != nil {
+		log.Printf("Direct connection for %s failed: %v", f.target, err)
+		return
+	}
+	if created {
+		log.Printf("Direct path from %s", direct.conn.RemoteAddr())
+	}
+
+	f.peers.Add(1)
+	defer f.peers.Add(-1)
+	<-direct.done
+}
+
+// peerSession is the direct session with one other client, shared by all
+// forwards between the two; a second connection between the same ports
+// could not be opened anyway.
+type peerSession struct {
+	connecting sync.Mutex
+	session    *muxSession
+	forwards   map[int]bool
+}
+
+func peerFor(thumbprint string) *peerSession {
+	punchMu.Lock()
+	defer punchMu.Unlock()
+	p := peerSessions[thumbprint]
+	if p == nil {
+		p = &peerSession{forwards: make(map[int]bool)}
+		peerSessions[thumbprint] = p
+	}
+	return p
+}
+
+// allowed reports whether the peer was offered the remote forward.
+func (p *peerSession) allowed(forward int) bool {
+	punchMu.Lock()
+	defer punchMu.Unlock()
+	return p.forwards[forward]
+}
+
+// openStream serves the streams the peer opens on the shared session, to
+// the remote forwards it was offered whichever side punched the session.
+func (p *peerSession) openStream(st *muxStream, payload []byte) {
+	var req muxRequest
+	if err := json.Unmarshal(payload, &req); err != nil || req.Peer != nil || !p.allowed(req.Forward) {
+		st.reject("invalid stream request")
+		return
+	}
+	serveRemoteStream(st, payload)
+}
+
+// connectPeer returns the direct session with the peer of offer, punching
+// a new one unless there is one already. serve offers the peer this side's
+// remote forward of offer; otherwise offer.Forward is the peer's own.
+func connectPeer(offer *peerOffer, serve bool) (*muxSession, bool, error) {
+	p := peerFor(offer.Thumbprint)
+	p.connecting.Lock()
+	defer p.connecting.Unlock()
+
+	punchMu.Lock()
+	if serve {
+		p.forwards[offer.Forward] = true
+	}
+	session := p.session
+	punchMu.Unlock()
+	if session != nil && session.Err() == nil {
+		return session, false, nil
+	}
+
+	conn, err := punch(offer)
+	if err != nil {
+		return nil, false, err
+	}
+	session = newMuxSession(conn, offer.Dial, p.openStream)
+	punchMu.Lock()
+	p.session = session
+	punchMu.Unlock()
+	return session, true, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+)
+
+// TestPeerSessionRoles checks that a direct session punched for this side's
+// -L still serves the peer once it is offered one of this side's -R, and
+// that the -L side does not offer anything by itself.
+func TestPeerSessionRoles(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	defer func(saved []*remoteForward) { remoteForwards = saved }(remoteForwards)
+	remoteForwards = []*remoteForward{{target: target.Addr().String()}, {target: target.Addr().String()}}
+
+	// The session as connectPeer punched it for this side's -L
+	const thumbprint = "peer-session-roles"
+	defer func() {
+		punchMu.Lock()
+		delete(peerSessions, thumbprint)
+		punchMu.Unlock()
+	}()
+	p := peerFor(thumbprint)
+	ours, theirs := tcpPair(t)
+	p.session = newMuxSession(ours, true, p.openStream)
+	peer := newMuxSession(theirs, false, func(st *muxStream, _ []byte) { st.reject("test") })
+	defer p.session.Close()
+	defer peer.Close()
+	if session, created, err := connectPeer(&peerOffer{Thumbprint: thumbprint, Forward: 1}, false); err != nil || created || session != p.session {
+		t.Fatalf("-L rendezvous did not reuse the session: %v %v", created, err)
+	}
+
+	open := func(forward int) (*muxStream, error) {
+		req, _ := json.Marshal(&muxRequest{Forward: forward})
+		return peer.open(req)
+	}
+	for forward := range remoteForwards {
+		if st, err := open(forward); err == nil {
+			st.Close()
+			t.Fatalf("forward %d served before it was offered", forward)
+		}
+	}
+
+	// This side's -R 0 is offered to the same peer
+	if session, created, err := connectPeer(&peerOffer{Thumbprint: thumbprint, Forward: 0}, true); err != nil || created || session != p.session {
+		t.Fatalf("-R offer did not reuse the session: %v %v", created, err)
+	}
+	st, err := open(0)
+	if err != nil {
+		t.Fatalf("offered forward refused: %v", err)
+	}
+	defer st.Close()
+	if _, err := st.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	st.CloseWrite()
+	if reply, err := io.ReadAll(st); err != nil || string(reply) != "ping" {
+		t.Fatalf("echo through the direct session: %q, %v", reply, err)
+	}
+	if st, err := open(1); err == nil {
+		st.Close()
+		t.Fatal("forward 1 served, only the peer's own forward 1 was used")
+	}
+}
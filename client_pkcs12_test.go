@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestLoadPKCS12 loads the bundles shipped with the .NET projects and
+// files exported by OpenSSL with modern and legacy encryption.
+func TestLoadPKCS12(t *testing.T) {
+	for _, path := range []string{
+		"AlphaTunnelClient/client.pfx",
+		"AlphaTunnel/server.pfx",
+		"HttpClientApp/client.pfx",
+		"HttpServerApp/server.pfx",
+		// openssl pkcs12 -export -keypbe AES-256-CBC -certpbe AES-256-CBC -macalg sha256
+		"testdata/aes256.p12",
+		// openssl pkcs12 -export -legacy -keypbe PBE-SHA1-3DES -certpbe PBE-SHA1-RC2-40
+		"testdata/rc2-legacy.p12",
+	} {
+		if !isPKCS12(path) {
+			t.Errorf("%s: not recognized as PKCS#12", path)
+			continue
+		}
+		cert, err := loadPKCS12(path, "1234")
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if cert.Leaf == nil || cert.PrivateKey == nil {
+			t.Errorf("%s: certificate or key missing", path)
+		}
+	}
+}
+
+func TestLoadPKCS12Errors(t *testing.T) {
+	for _, path := range []string{"AlphaTunnelClient/client.pfx", "testdata/aes256.p12", "testdata/rc2-legacy.p12"} {
+		if _, err := loadPKCS12(path, "4321"); !errors.Is(err, errPKCS12BadPassword) {
+			t.Errorf("%s with a wrong password: %v, want %v", path, err, errPKCS12BadPassword)
+		}
+	}
+
+	// openssl pkcs12 -export -legacy -keypbe PBE-SHA1-RC4-128 -certpbe PBE-SHA1-RC4-128
+	_, err := loadPKCS12("testdata/rc4-unsupported.p12", "1234")
+	if err == nil || !strings.Contains(err.Error(), "unsupported PKCS#12 encryption") {
+		t.Errorf("RC4 encrypted file: %v, want an unsupported encryption error", err)
+	}
+}
+
+// TestRC2 checks decryption against the vectors of RFC 2268.
+func TestRC2(t *testing.T) {
+	for _, tc := range []struct {
+		key, plain, cipher string
+		bits               int
+	}{
+		{"0000000000000000", "0000000000000000", "ebb773f993278eff", 63},
+		{"ffffffffffffffff", "ffffffffffffffff", "278b27e42e2f0d49", 64},
+		{"3000000000000000", "1000000000000001", "30649edf9be7d2c2", 64},
+		{"88", "0000000000000000", "61a8a244adacccf0", 64},
+		{"88bca90e90875a", "0000000000000000", "6ccf4308974c267f", 64},
+		{"88bca90e90875a7f0f79c384627bafb2", "0000000000000000", "1a807d272bbe5db1", 64},
+		{"88bca90e90875a7f0f79c384627bafb2", "0000000000000000", "2269552ab0f85ca6", 128},
+	} {
+		key, _ := hex.DecodeString(tc.key)
+		plain, _ := hex.DecodeString(tc.plain)
+		want, _ := hex.DecodeString(tc.cipher)
+		block, err := newRC2Cipher(key, tc.bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 8)
+		block.Decrypt(got, want)
+		if !bytes.Equal(got, plain) {
+			t.Errorf("key %s, %d bits: decrypted to %x, want %s", tc.key, tc.bits, got, tc.plain)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	sessionStarting = iota
+	sessionIdle
+	sessionActive
+)
+
+var errIdleExpired = errors.New("warm session expired")
+
+// tunnelPool keeps pre-authenticated sessions idle at the relay so that a
+// public connection does not wait for a TLS handshake.
+type tunnelPool struct {
+	min         int
+	max         int
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	counts  [3]int
+	changed chan struct{}
+}
+
+type warmSession struct {
+	pool  *tunnelPool
+	state int
+}
+
+var warmPool *tunnelPool
+
+func newTunnelPool(min, max int, idleTimeout time.Duration) (*tunnelPool, error) {
+	if min < 1 || max < min {
+		return nil, fmt.Errorf("invalid pool bounds: min %d, max %d", min, max)
+	}
+	return &tunnelPool{min: min, max: max, idleTimeout: idleTimeout, changed: make(chan struct{}, 1)}, nil
+}
+
+func (p *tunnelPool) notify() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// run keeps min sessions ready without going over max sessions in total.
+func (p *tunnelPool) run() {
+	for {
+		p.mu.Lock()
+		for p.counts[sessionStarting]+p.counts[sessionIdle] < p.min && p.total() < p.max {
+			p.counts[sessionStarting]++
+			go p.serve(&warmSession{pool: p})
+		}
+		p.mu.Unlock()
+		<-p.changed
+	}
+}
+
+func (p *tunnelPool) total() int {
+	return p.counts[sessionStarting] + p.counts[sessionIdle] + p.counts[sessionActive]
+}
+
+func (p *tunnelPool) serve(s *warmSession) {
+	waitUntilActive()
+	tunnelShaper.waitForQuota()
+
+	err := connectAndForwardTCP(s)
+	if err != nil && !errors.Is(err, errIdleExpired) {
+		log.Printf("Error: %v\n", err)
+		log.Println("Retrying in 5 seconds...")
+		// Keep the slot so that a broken relay is not hammered
+		time.Sleep(5 * time.Second)
+	}
+
+	p.mu.Lock()
+	p.counts[s.state]--
+	p.mu.Unlock()
+	p.notify()
+}
+
+func (s *warmSession) setState(state int) {
+	p := s.pool
+	p.mu.Lock()
+	p.counts[s.state]--
+	p.counts[state]++
+	s.state = state
+	p.mu.Unlock()
+	p.notify()
+}
+
+// waitForStream idles until the relay hands this session a public
+// connection.
+func (s *warmSession) waitForStream(conn net.Conn) (*streamStart, error) {
+	s.setState(sessionIdle)
+
+	// The relay expires idle sessions itself; the deadline only catches a
+	// relay that went away silently.
+	if s.pool.idleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.pool.idleTimeout + 30*time.Second))
+	}
+	start := &streamStart{}
+	if err := readJSONFrame(conn, start); err != nil {
+		if netErr, ok := err.(net.Error); err == io.EOF || ok && netErr.Timeout() {
+			return nil, errIdleExpired
+		}
+		return nil, fmt.Errorf("failed to wait for stream: %v", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	s.setState(sessionActive)
+	return start, nil
+}
+
+func (p *tunnelPool) status() *poolStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return &poolStatus{
+		Starting: p.counts[sessionStarting],
+		Idle:     p.counts[sessionIdle],
+		Active:   p.counts[sessionActive],
+		Min:      p.min,
+		Max:      p.max,
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// openRelayStream asks the relay to connect to dest on its network and
+// returns the stream once the relay has reached it. A nil conn with a
+// non-nil reply means the relay refused or could not reach dest.
+func openRelayStream(dest string) (net.Conn, *tunnelReply, error) {
+	host, portStr, err := net.SplitHostPort(dest)
+	port, _ := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, &tunnelReply{Error: "invalid destination " + dest, Code: "failed"}, nil
+	}
+	if len(proxyAllowed) > 0 && !proxyAllowed.allows(host, nil, port) {
+		return nil, &tunnelReply{Error: "destination " + dest + " not allowed", Code: "denied"}, nil
+	}
+
+	cert, err := loadClientCert()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load client certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+	}
+
+	relayAddr := relays.currentAddr()
+	conn, err := dialRelay(relayAddr, config)
+	if err != nil {
+		relays.reportFailure(relayAddr)
+		return nil, nil, fmt.Errorf("failed to connect to server %s: %v", relayAddr, err)
+	}
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	hello := &tunnelHello{Connect: dest}
+	if compress {
+		hello.Compression = []string{compressionDeflate}
+	}
+	if err := writeHello(conn, hello); err != nil {
+		conn.Close()
+		relays.reportFailure(relayAddr)
+		return nil, nil, fmt.Errorf("failed to send hello: %v", err)
+	}
+	_, reply, err := readReply(conn)
+	if err != nil {
+		conn.Close()
+		relays.reportFailure(relayAddr)
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	relays.reportSuccess(relayAddr, relayAddr)
+
+	if reply.Error != "" {
+		conn.Close()
+		return nil, reply, nil
+	}
+	stream := tunnelShaper.shapeConn(conn)
+	if reply.Compression != "" {
+		stream = newCompressedConn(stream)
+	}
+	return stream, reply, nil
+}
+
+func proxyAuthorized(user, pass string) bool {
+	return proxyUser == "" || (user == proxyUser && pass == proxyPass)
+}
+
+func handleSOCKS5(localConn net.Conn, reader *bufio.Reader) {
+	var auth func(user, pass string) bool
+	if proxyUser != "" {
+		auth = proxyAuthorized
+	}
+	dest, _, err := readSOCKS5Request(localConn, reader, auth)
+	if err != nil {
+		log.Printf("SOCKS5 request from %s rejected: %v", localConn.RemoteAddr(), err)
+		return
+	}
+
+	stream, reply, err := openRelayStream(dest)
+	if err != nil {
+		log.Printf("SOCKS5 connect to %s failed: %v", dest, err)
+		writeSOCKS5Reply(localConn, socks5GeneralFailure)
+		return
+	}
+	if stream == nil {
+		log.Printf("SOCKS5 connect to %s refused: %s", dest, reply.Error)
+		writeSOCKS5Reply(localConn, socks5ReplyCode(reply.Code))
+		return
+	}
+	defer stream.Close()
+
+	writeSOCKS5Reply(localConn, socks5Succeeded)
+	log.Printf("SOCKS5 %s -> %s", localConn.RemoteAddr(), dest)
+	proxyStreams(localConn, reader, stream)
+}
+
+func checkProxyAuthorization(localConn net.Conn, req *http.Request) bool {
+	if proxyUser == "" {
+		return true
+	}
+
+	if proxyAuthorized(parseProxyAuthorization(req)) {
+		return true
+	}
+
+	log.Printf("Proxy authentication failed for %s", localConn.RemoteAddr())
+	writeProxyAuthRequired(localConn)
+	return false
+}
+
+func writeProxyError(localConn net.Conn, dest string, reply *tunnelReply, err error) {
+	status := http.StatusBadGateway
+	if err != nil {
+		log.Printf("Proxy connect to %s failed: %v", dest, err)
+	} else {
+		log.Printf("Proxy connect to %s refused: %s", dest, reply.Error)
+		if reply.Code == "denied" {
+			status = http.StatusForbidden
+		}
+	}
+	fmt.Fprintf(localConn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+}
+
+func handleHTTPConnect(localConn net.Conn, reader *bufio.Reader, req *http.Request) {
+	if !checkProxyAuthorization(localConn, req) {
+		return
+	}
+
+	dest := req.Host
+	if _, _, err := net.SplitHostPort(dest); err != nil {
+		dest = net.JoinHostPort(dest, "443")
+	}
+
+	stream, reply, err := openRelayStream(dest)
+	if stream == nil {
+		writeProxyError(localConn, dest, reply, err)
+		return
+	}
+	defer stream.Close()
+
+	io.WriteString(localConn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	log.Printf("CONNECT %s -> %s", localConn.RemoteAddr(), dest)
+	proxyStreams(localConn, reader, stream)
+}
+
+// handleHTTPProxy serves absolute-form requests (plain http:// through the
+// proxy), opening a relay stream per request.
+func handleHTTPProxy(localConn net.Conn, reader *bufio.Reader, req *http.Request) {
+	for {
+		if !checkProxyAuthorization(localConn, req) {
+			return
+		}
+
+		dest := req.URL.Host
+		if req.URL.Port() == "" {
+			dest = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+
+		stream, reply, err := openRelayStream(dest)
+		if stream == nil {
+			writeProxyError(localConn, dest, reply, err)
+			return
+		}
+
+		req.Header.Del("Proxy-Authorization")
+		req.Header.Del("Proxy-Connection")
+		if err := req.Write(stream); err != nil {
+			stream.Close()
+			log.Printf("Error forwarding proxy request to %s: %v", dest, err)
+			return
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(stream), req)
+		if err != nil {
+			stream.Close()
+			log.Printf("Error reading proxy response from %s: %v", dest, err)
+			writeProxyError(localConn, dest, nil, err)
+			return
+		}
+		err = resp.Write(localConn)
+		resp.Body.Close()
+		stream.Close()
+		if err != nil {
+			return
+		}
+		log.Printf("Proxied request: %s %s\n", req.Method, req.URL)
+
+		if req.Close || resp.Close {
+			return
+		}
+		req, err = http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		if !req.URL.IsAbs() {
+			writeProxyError(localConn, req.Host, &tunnelReply{Error: "origin-form request on proxy connection"}, nil)
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+)
+
+// router sends the HTTP requests of TCP-mode tunnels to the local service
+// their path routes to.
+type router struct {
+	table     *routeTable
+	transport http.RoundTripper
+}
+
+// routeTransport speaks h2c to local gRPC services and HTTP/1.1 to the
+// others.
+type routeTransport struct {
+	h2c *http.Transport
+}
+
+func (t *routeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isGRPC(req) {
+		return t.h2c.RoundTrip(req)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// startRouter serves the routing table on a loopback port and returns its
+// address, so that it can be used as a local target like any other backend.
+func startRouter(table *routeTable) (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("failed to start router: %v", err)
+	}
+
+	// Public clients may speak h2c through the tunnel as well
+	server := &http.Server{
+		Handler:   &router{table: table, transport: &routeTransport{h2c: newH2CTransport()}},
+		Protocols: new(http.Protocols),
+	}
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Printf("Router error: %v", err)
+		}
+	}()
+	log.Printf("Routing HTTP requests on %s", listener.Addr())
+	return listener.Addr().String(), nil
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route, matched := rt.table.match(r.URL.Path)
+	if route == nil {
+		http.NotFound(w, r)
+		return
+	}
+	var scope *rewriteScope
+	if rw := route.rewriteFor(matched); rw != nil {
+		var ok bool
+		if scope, ok = rw.rewriteRequest(r, route.Target); !ok {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = route.Target
+		},
+		Transport: rt.transport,
+		// Streams (gRPC, server-sent events) are passed on as they come
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			if scope != nil {
+				scope.rewriteResponse(resp)
+			}
+			return nil
+		},
+		ErrorLog: log.Default(),
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+// TestRouterHost checks that the TCP-mode router passes the public Host
+// unless the route's rewrite sets another, like http_relay_client does.
+func TestRouterHost(t *testing.T) {
+	path, target := writeHostRoutes(t)
+	table, err := loadRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := startRouter(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := getHost(t, addr, "/public"); got != "public.example.com" {
+		t.Errorf("route without host rule: Host %q, want public.example.com", got)
+	}
+	if got := getHost(t, addr, "/target"); got != target {
+		t.Errorf(`route with "host": "target": Host %q, want %q`, got, target)
+	}
+}
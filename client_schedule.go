@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// activeWindow is one entry of a schedule such as "Mon-Fri 09:00-17:30".
+// A window whose end is before its start runs past midnight.
+type activeWindow struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+var (
+	tunnelExpiresAt time.Time
+	tunnelSchedule  []activeWindow
+	// relayDeadline also sends the deadline in the hello, which only the Go
+	// relay understands; by default the client enforces it alone.
+	relayDeadline bool
+)
+
+var weekdayNames = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+
+// parseSchedule parses ';'-separated windows. Days take cron-like lists and
+// ranges ("Mon-Fri", "Sat,Sun", "*"); times are local HH:MM-HH:MM.
+func parseSchedule(spec string) ([]activeWindow, error) {
+	var windows []activeWindow
+	for _, entry := range strings.Split(spec, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid schedule window %q, expected \"<days> HH:MM-HH:MM\"", entry)
+		}
+
+		var w activeWindow
+		for _, part := range strings.Split(strings.ToLower(fields[0]), ",") {
+			if part == "*" {
+				w.days = [7]bool{true, true, true, true, true, true, true}
+				continue
+			}
+			from, to, isRange := strings.Cut(part, "-")
+			first, ok1 := weekdayNames[from]
+			last, ok2 := first, true
+			if isRange {
+				last, ok2 = weekdayNames[to]
+			}
+			if !ok1 || !ok2 {
+				return nil, fmt.Errorf("invalid days %q in schedule", fields[0])
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+
+		start, end, ok := strings.Cut(fields[1], "-")
+		var err error
+		if w.start, err = parseClock(start); ok && err == nil {
+			w.end, err = parseClock(end)
+		}
+		if !ok || err != nil || w.start == w.end {
+			return nil, fmt.Errorf("invalid times %q in schedule", fields[1])
+		}
+		windows = append(windows, w)
+	}
+	if len(windows) == 0 {
+		return nil, fmt.Errorf("empty schedule")
+	}
+	return windows, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// windowEnd returns the end of the window active at t, if any.
+func windowEnd(windows []activeWindow, t time.Time) (time.Time, bool) {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	minute := t.Hour()*60 + t.Minute()
+	var end time.Time
+	for _, w := range windows {
+		var until time.Time
+		switch {
+		case w.start < w.end && w.days[t.Weekday()] && minute >= w.start && minute < w.end:
+			until = day.Add(time.Duration(w.end) * time.Minute)
+		case w.start > w.end && w.days[t.Weekday()] && minute >= w.start:
+			until = day.AddDate(0, 0, 1).Add(time.Duration(w.end) * time.Minute)
+		case w.start > w.end && w.days[(t.Weekday()+6)%7] && minute < w.end:
+			// Started yesterday and runs past midnight
+			until = day.Add(time.Duration(w.end) * time.Minute)
+		default:
+			continue
+		}
+		if until.After(end) {
+			end = until
+		}
+	}
+	return end, !end.IsZero()
+}
+
+// nextWindowStart returns when the next window opens after t.
+func nextWindowStart(windows []activeWindow, t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	var next time.Time
+	for offset := 0; offset <= 7; offset++ {
+		d := day.AddDate(0, 0, offset)
+		for _, w := range windows {
+			start := d.Add(time.Duration(w.start) * time.Minute)
+			if w.days[d.Weekday()] && start.After(t) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+		if !next.IsZero() {
+			return next
+		}
+	}
+	return next
+}
+
+// tunnelDeadline returns when the tunnel must go down next, or the zero
+// time when it has no time limit.
+func tunnelDeadline() time.Time {
+	deadline := tunnelExpiresAt
+	if len(tunnelSchedule) > 0 {
+		if end, ok := windowEnd(tunnelSchedule, time.Now()); ok && (deadline.IsZero() || end.Before(deadline)) {
+			deadline = end
+		}
+	}
+	return deadline
+}
+
+// waitUntilActive exits once the tunnel has expired and sleeps while the
+// schedule is outside its active windows.
+func waitUntilActive() {
+	for {
+		if !tunnelExpiresAt.IsZero() && !time.Now().Before(tunnelExpiresAt) {
+			log.Printf("Tunnel expired at %s. Closing tunnel...", tunnelExpiresAt.Format(time.RFC3339))
+			os.Exit(0)
+		}
+		if len(tunnelSchedule) == 0 {
+			return
+		}
+		if _, ok := windowEnd(tunnelSchedule, time.Now()); ok {
+			return
+		}
+
+		next := nextWindowStart(tunnelSchedule, time.Now())
+		if !tunnelExpiresAt.IsZero() && next.After(tunnelExpiresAt) {
+			next = tunnelExpiresAt
+		}
+		log.Printf("Outside the tunnel schedule, waiting until %s", next.Format(time.RFC3339))
+		time.Sleep(time.Until(next))
+	}
+}
+
+// closeAtDeadline closes c when the current active period ends; the
+// returned function cancels that.
+func closeAtDeadline(c interface{ Close() error }) func() bool {
+	deadline := tunnelDeadline()
+	if deadline.IsZero() {
+		return func() bool { return false }
+	}
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		log.Printf("Tunnel active period ended at %s. Closing connection...", deadline.Format(time.RFC3339))
+		c.Close()
+	})
+	return timer.Stop
+}
+
+// deadlineHello returns the extended hello telling the relay when to close
+// the public side, using ClientRelayPort's StartedTime and TotalMinutes.
+// It is nil without -relay-deadline or a time limit, so that the plain key
+// still works with the C# relay.
+func deadlineHello() *tunnelHello {
+	deadline := tunnelDeadline()
+	if !relayDeadline || deadline.IsZero() {
+		return nil
+	}
+	minutes := int(math.Ceil(time.Until(deadline).Minutes()))
+	if minutes < 1 {
+		minutes = 1
+	}
+	return &tunnelHello{
+		StartedTime:  deadline.Add(-time.Duration(minutes) * time.Minute).UTC(),
+		TotalMinutes: &minutes,
+	}
+}
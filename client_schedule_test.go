@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestDeadlineHello checks that a time limit alone keeps the plain key, so
+// the tunnel still reaches the C# relay, and -relay-deadline sends it.
+func TestDeadlineHello(t *testing.T) {
+	defer func(expires time.Time, send bool) {
+		tunnelExpiresAt, relayDeadline = expires, send
+	}(tunnelExpiresAt, relayDeadline)
+
+	tunnelExpiresAt = time.Now().Add(90 * time.Minute)
+	relayDeadline = false
+	if hello := deadlineHello(); hello != nil {
+		t.Errorf("without -relay-deadline got hello %+v, want the plain key", hello)
+	}
+
+	relayDeadline = true
+	hello := deadlineHello()
+	if hello == nil || hello.TotalMinutes == nil {
+		t.Fatalf("with -relay-deadline got hello %+v, want a deadline", hello)
+	}
+	if *hello.TotalMinutes != 90 {
+		t.Errorf("TotalMinutes is %d, want 90", *hello.TotalMinutes)
+	}
+	if end := hello.StartedTime.Add(time.Duration(*hello.TotalMinutes) * time.Minute); !end.Equal(tunnelExpiresAt.UTC()) {
+		t.Errorf("hello ends at %s, want %s", end, tunnelExpiresAt.UTC())
+	}
+
+	tunnelExpiresAt = time.Time{}
+	if hello := deadlineHello(); hello != nil {
+		t.Errorf("without a time limit got hello %+v", hello)
+	}
+}
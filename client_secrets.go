@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secrets are referenced as "secret:<name>" in flags that take passwords or
+// key files. They are kept in an AES-256-GCM encrypted file whose key comes
+// from a passphrase (scrypt) or a keyfile, and are decrypted only in memory.
+const secretRefPrefix = "secret:"
+
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+type secretFile struct {
+	Version int
+	// KDF is "scrypt" (passphrase) or "keyfile" (SHA-256 of the keyfile).
+	KDF  string
+	Salt []byte `json:",omitempty"`
+	N    int    `json:",omitempty"`
+	R    int    `json:",omitempty"`
+	P    int    `json:",omitempty"`
+	// Check is an empty value sealed with the key, to tell a wrong
+	// passphrase from a damaged secret.
+	Check   []byte
+	Secrets map[string]*sealedSecret
+}
+
+type sealedSecret struct {
+	Nonce      []byte
+	Ciphertext []byte
+	Added      time.Time
+}
+
+type secretStore struct {
+	path string
+	file secretFile
+	aead cipher.AEAD
+	key  []byte
+
+	mu     sync.Mutex
+	opened map[string][]byte
+}
+
+// secrets is the store the client's secret: references are resolved from.
+var secrets *secretStore
+
+const secretCheckLabel = "ssl_tunnel secret store"
+
+// openSecretStore opens path, or creates it when create is set. Without a
+// keyfile the passphrase comes from $TUNNEL_STORE_PASSPHRASE or a prompt.
+func openSecretStore(path, keyfile string, create bool) (*secretStore, error) {
+	s := &secretStore{path: path, opened: make(map[string][]byte)}
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &s.file); err != nil {
+			return nil, fmt.Errorf("failed to parse secret store %s: %v", path, err)
+		}
+	case os.IsNotExist(err) && create:
+		s.file = secretFile{Version: 1, KDF: "keyfile", Secrets: make(map[string]*sealedSecret)}
+		if keyfile == "" {
+			s.file.KDF, s.file.N, s.file.R, s.file.P = "scrypt", scryptN, scryptR, scryptP
+			s.file.Salt = make([]byte, 16)
+			if _, err := rand.Read(s.file.Salt); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("failed to open secret store: %v", err)
+	}
+	if s.file.Secrets == nil {
+		s.file.Secrets = make(map[string]*sealedSecret)
+	}
+
+	switch s.file.KDF {
+	case "keyfile":
+		if keyfile == "" {
+			return nil, fmt.Errorf("secret store %s needs -secret-keyfile", path)
+		}
+		raw, err := os.ReadFile(keyfile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keyfile: %v", err)
+		}
+		if len(raw) < 32 {
+			wipe(raw)
+			return nil, fmt.Errorf("keyfile %s is too short, use at least 32 random bytes", keyfile)
+		}
+		sum := sha256.Sum256(raw)
+		wipe(raw)
+		s.key = sum[:]
+	case "scrypt":
+		if keyfile != "" {
+			return nil, fmt.Errorf("secret store %s is protected by a passphrase, not a keyfile", path)
+		}
+		passphrase, err := readPassphrase("Secret store passphrase: ", create && s.file.Check == nil)
+		if err != nil {
+			return nil, err
+		}
+		s.key, err = scryptKey(passphrase, s.file.Salt, s.file.N, s.file.R, s.file.P, 32)
+		wipe(passphrase)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown key derivation %q in %s", s.file.KDF, path)
+	}
+
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+	if s.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+
+	if s.file.Check == nil {
+		s.file.Check = s.seal(secretCheckLabel, nil)
+	} else if _, err := s.openSealed(secretCheckLabel, s.file.Check); err != nil {
+		s.wipe()
+		return nil, fmt.Errorf("wrong passphrase or keyfile for %s", path)
+	}
+	return s, nil
+}
+
+// seal encrypts value with a fresh nonce in front; the name is bound as
+// additional data so that entries cannot be swapped.
+func (s *secretStore) seal(name string, value []byte) []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	rand.Read(nonce)
+	return s.aead.Seal(nonce, nonce, value, []byte(name))
+}
+
+func (s *secretStore) openSealed(name string, sealed []byte) ([]byte, error) {
+	size := s.aead.NonceSize()
+	if len(sealed) < size {
+		return nil, errors.New("truncated secret")
+	}
+	return s.aead.Open(nil, sealed[:size], sealed[size:], []byte(name))
+}
+
+func (s *secretStore) save() error {
+	data, err := json.MarshalIndent(&s.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *secretStore) add(name string, value []byte) error {
+	sealed := s.seal(name, value)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.file.Secrets[name] = &sealedSecret{Nonce: sealed[:s.aead.NonceSize()], Ciphertext: sealed[s.aead.NonceSize():], Added: time.Now()}
+	return s.save()
+}
+
+func (s *secretStore) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.file.Secrets[name]; !ok {
+		return fmt.Errorf("no secret named %q", name)
+	}
+	delete(s.file.Secrets, name)
+	if v, ok := s.opened[name]; ok {
+		wipe(v)
+		delete(s.opened, name)
+	}
+	return s.save()
+}
+
+// get decrypts a secret; the plaintext stays cached until wipe.
+func (s *secretStore) get(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.opened[name]; ok {
+		return v, nil
+	}
+	entry, ok := s.file.Secrets[name]
+	if !ok {
+		return nil, fmt.Errorf("no secret named %q in %s", name, s.path)
+	}
+	v, err := s.aead.Open(nil, entry.Nonce, entry.Ciphertext, []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("secret %q is damaged: %v", name, err)
+	}
+	s.opened[name] = v
+	return v, nil
+}
+
+// wipe zeroes the key and all decrypted secrets. Strings made from
+// secrets (passwords handed to other packages) cannot be reached.
+func (s *secretStore) wipe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, v := range s.opened {
+		wipe(v)
+		delete(s.opened, name)
+	}
+	wipe(s.key)
+	s.aead = nil
+}
+
+func wipe(b []byte) {
+	clear(b)
+}
+
+// resolveSecret returns value, or the named secret when value is a
+// "secret:<name>" reference.
+func resolveSecret(value string) (string, error) {
+	name, ok := strings.CutPrefix(value, secretRefPrefix)
+	if !ok {
+		return value, nil
+	}
+	if secrets == nil {
+		return "", fmt.Errorf("%s needs -secret-store", value)
+	}
+	v, err := secrets.get(name)
+	if err != nil {
+		return "", err
+	}
+	return string(v), nil
+}
+
+// loadKeyPair is tls.LoadX509KeyPair with keyFile optionally naming a
+// secret that holds the PEM key.
+func loadKeyPair(certFile, keyFile string) (tls.Certificate, error) {
+	name, ok := strings.CutPrefix(keyFile, secretRefPrefix)
+	if !ok {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+	if secrets == nil {
+		return tls.Certificate{}, fmt.Errorf("%s needs -secret-store", keyFile)
+	}
+	keyPEM, err := secrets.get(name)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// usesSecrets reports whether any of values is a secret reference.
+func usesSecrets(values ...string) bool {
+	return slices.ContainsFunc(values, func(v string) bool { return strings.HasPrefix(v, secretRefPrefix) })
+}
+
+// readPassphrase reads from $TUNNEL_STORE_PASSPHRASE or the terminal,
+// with echo off, asking twice for a new passphrase.
+func readPassphrase(prompt string, confirm bool) ([]byte, error) {
+	if env := os.Getenv("TUNNEL_STORE_PASSPHRASE"); env != "" {
+		return []byte(env), nil
+	}
+	if !isTerminal(os.Stdin) {
+		return nil, fmt.Errorf("no passphrase: set TUNNEL_STORE_PASSPHRASE or use a keyfile")
+	}
+
+	first, err := readHidden(prompt)
+	if err != nil {
+		return nil, err
+	}
+	if len(first) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	if confirm {
+		second, err := readHidden("Repeat passphrase: ")
+		if err != nil {
+			wipe(first)
+			return nil, err
+		}
+		match := string(first) == string(second)
+		wipe(second)
+		if !match {
+			wipe(first)
+			return nil, fmt.Errorf("passphrases do not match")
+		}
+	}
+	return first, nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// readHidden reads a line from the terminal with echo turned off by stty.
+func readHidden(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	stty := func(arg string) {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = os.Stdin
+		cmd.Run()
+	}
+	stty("-echo")
+	line, err := stdinReader.ReadBytes('\n')
+	stty("echo")
+	fmt.Fprintln(os.Stderr)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	for len(line) > 0 && (line[len(line)-1] == '\n' || line[len(line)-1] == '\r') {
+		line[len(line)-1] = 0
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// runSecretCommand implements "secret add|list|remove".
+func runSecretCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s secret add|list|remove [flags] [name]", os.Args[0])
+	}
+
+	fs := flag.NewFlagSet("secret "+args[0], flag.ExitOnError)
+	path := fs.String("store", "ssl_tunnel_secrets.json", "Path of the secret store")
+	keyfile := fs.String("keyfile", "", "Keyfile protecting the store instead of a passphrase")
+	fromFile := fs.String("from-file", "", "Read the secret from this file (add; default stdin or a prompt)")
+	fs.Parse(args[1:])
+
+	store, err := openSecretStore(*path, *keyfile, args[0] == "add")
+	if err != nil {
+		return err
+	}
+	defer store.wipe()
+
+	switch args[0] {
+	case "add":
+		name := fs.Arg(0)
+		if name == "" || strings.ContainsAny(name, " \t\n") {
+			return fmt.Errorf("usage: %s secret add [flags] <name>", os.Args[0])
+		}
+		var value []byte
+		switch {
+		case *fromFile != "":
+			value, err = os.ReadFile(*fromFile)
+		case isTerminal(os.Stdin):
+			value, err = readHidden(fmt.Sprintf("Value of %s: ", name))
+		default:
+			value, err = io.ReadAll(os.Stdin)
+			value = []byte(strings.TrimRight(string(value), "\r\n"))
+		}
+		if err != nil {
+			return err
+		}
+		defer wipe(value)
+		if len(value) == 0 {
+			return fmt.Errorf("empty secret")
+		}
+		if err := store.add(name, value); err != nil {
+			return err
+		}
+		fmt.Printf("Stored %s in %s\n", name, *path)
+
+	case "list":
+		names := make([]string, 0, len(store.file.Secrets))
+		for name := range store.file.Secrets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%-30s added %s\n", name, store.file.Secrets[name].Added.Format(time.RFC3339))
+		}
+
+	case "remove":
+		if fs.Arg(0) == "" {
+			return fmt.Errorf("usage: %s secret remove [flags] <name>", os.Args[0])
+		}
+		if err := store.remove(fs.Arg(0)); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s from %s\n", fs.Arg(0), *path)
+
+	default:
+		return fmt.Errorf("unknown secret command %q", args[0])
+	}
+	return nil
+}
+
+// scryptKey is scrypt (RFC 7914) over PBKDF2-HMAC-SHA256.
+func scryptKey(password, salt []byte, n, r, p, keyLen int) ([]byte, error) {
+	if n <= 1 || n&(n-1) != 0 || r <= 0 || p <= 0 || uint64(r)*uint64(p) >= 1<<30 || n > 1<<24 {
+		return nil, fmt.Errorf("invalid scrypt parameters N=%d r=%d p=%d", n, r, p)
+	}
+	b, err := pbkdf2.Key(sha256.New, string(password), salt, 1, p*128*r)
+	if err != nil {
+		return nil, err
+	}
+	x := make([]uint32, 32*r)
+	y := make([]uint32, 32*r)
+	v := make([]uint32, 32*r*n)
+	for i := 0; i < p; i++ {
+		block := b[i*128*r : (i+1)*128*r]
+		for j := range x {
+			x[j] = binary.LittleEndian.Uint32(block[4*j:])
+		}
+		for j := 0; j < n; j++ {
+			copy(v[j*32*r:], x)
+			blockMix(x, y, r)
+		}
+		for j := 0; j < n; j++ {
+			k := int(x[(2*r-1)*16] & uint32(n-1))
+			for m := range x {
+				x[m] ^= v[k*32*r+m]
+			}
+			blockMix(x, y, r)
+		}
+		for j := range x {
+			binary.LittleEndian.PutUint32(block[4*j:], x[j])
+		}
+	}
+	clear(v)
+	key, err := pbkdf2.Key(sha256.New, string(password), b, 1, keyLen)
+	wipe(b)
+	return key, err
+}
+
+// blockMix is scrypt's BlockMix with Salsa20/8; y is scratch space.
+func blockMix(b, y []uint32, r int) {
+	var t [16]uint32
+	copy(t[:], b[(2*r-1)*16:])
+	for i := 0; i < 2*r; i++ {
+		for j := range t {
+			t[j] ^= b[i*16+j]
+		}
+		salsa208(&t)
+		// Even blocks go to the first half, odd ones to the second
+		copy(y[(i/2+(i%2)*r)*16:], t[:])
+	}
+	copy(b, y)
+}
+
+func salsa208(b *[16]uint32) {
+	x := *b
+	for i := 0; i < 8; i += 2 {
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+	for i := range b {
+		b[i] += x[i]
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestScrypt checks scryptKey against the test vectors of RFC 7914.
+func TestScrypt(t *testing.T) {
+	for _, tc := range []struct {
+		password, salt string
+		n, r, p        int
+		want           string
+	}{
+		{"", "", 16, 1, 1, "77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16, "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b3731622eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+		{"pleaseletmein", "SodiumChloride", 16384, 8, 1, "7023bdcb3afd7348461c06cd81fd38ebfda8fbba904f8e3ea9b543f6545da1f2d5432955613f0fcf62d49705242a9af9e61e85dc0d651e40dfcf017b45575887"},
+		{"pleaseletmein", "SodiumChloride", 1048576, 8, 1, "2101cb9b6a511aaeaddbbe09cf70f881ec568d574a2ffd4dabe5ee9820adaa478e56fd8f4ba5d09ffa1c6d927c40f4c337304049e8a952fbcbf45c6fa77a41a4"},
+	} {
+		if tc.n > scryptN && testing.Short() {
+			// 1 GiB of memory
+			continue
+		}
+		got, err := scryptKey([]byte(tc.password), []byte(tc.salt), tc.n, tc.r, tc.p, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, _ := hex.DecodeString(tc.want); !bytes.Equal(got, want) {
+			t.Errorf("scrypt(%q, %q, N=%d, r=%d, p=%d) = %x, want %s", tc.password, tc.salt, tc.n, tc.r, tc.p, got, tc.want)
+		}
+	}
+}
+
+// TestSecretStore adds, lists and removes a secret across reopened stores
+// and checks that a wrong passphrase is refused.
+func TestSecretStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.json")
+	t.Setenv("TUNNEL_STORE_PASSPHRASE", "correct horse")
+
+	store, err := openSecretStore(path, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.add("db-password", []byte("hunter2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.add("api-key", []byte("k-123")); err != nil {
+		t.Fatal(err)
+	}
+	store.wipe()
+
+	store, err = openSecretStore(path, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.file.Secrets) != 2 || store.file.Secrets["db-password"] == nil || store.file.Secrets["api-key"] == nil {
+		t.Fatalf("listed %v, want api-key and db-password", store.file.Secrets)
+	}
+	if value, err := store.get("db-password"); err != nil || string(value) != "hunter2" {
+		t.Fatalf("get: %q, %v", value, err)
+	}
+	if err := store.remove("api-key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.remove("api-key"); err == nil {
+		t.Fatal("removed a missing secret")
+	}
+	store.wipe()
+
+	store, err = openSecretStore(path, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.get("api-key"); err == nil {
+		t.Fatal("removed secret still there")
+	}
+	if value, err := store.get("db-password"); err != nil || string(value) != "hunter2" {
+		t.Fatalf("get after remove: %q, %v", value, err)
+	}
+	store.wipe()
+
+	t.Setenv("TUNNEL_STORE_PASSPHRASE", "wrong horse")
+	if _, err := openSecretStore(path, "", false); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Fatalf("wrong passphrase: %v", err)
+	}
+}
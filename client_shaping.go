@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	b := &tokenBucket{last: time.Now()}
+	b.setRate(rate)
+	b.tokens = b.burst
+	return b
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rate = float64(rate)
+	// Allow a tenth of a second worth of data in one go, but not so little
+	// that every read turns into a sleep
+	b.burst = b.rate / 10
+	if b.burst < 16*1024 {
+		b.burst = 16 * 1024
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// take reserves up to n bytes, sleeping as long as the reservation needs,
+// and returns how many were reserved.
+func (b *tokenBucket) take(n int) int {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if float64(n) > b.burst {
+		n = int(b.burst)
+	}
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	time.Sleep(wait)
+	return n
+}
+
+// wait charges n bytes that have already been transferred.
+func (b *tokenBucket) wait(n int) {
+	for n > 0 {
+		n -= b.take(n)
+	}
+}
+
+// quotaState is persisted so that quotas survive restarts.
+type quotaState struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"dayBytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"monthBytes"`
+}
+
+type shaper struct {
+	upRate    int64
+	downRate  int64
+	fairShare bool
+	up        *tokenBucket
+	down      *tokenBucket
+
+	dailyQuota   int64
+	monthlyQuota int64
+	quotaPolicy  string
+	quotaPath    string
+
+	bytesUp   atomic.Int64
+	bytesDown atomic.Int64
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	state     quotaState
+	exhausted bool
+	dirty     bool
+	conns     map[*shapedConn]bool
+}
+
+// maxShapedRead keeps rate limited reads small so the data arrives evenly.
+const maxShapedRead = 32 * 1024
+
+var tunnelShaper = &shaper{conns: make(map[*shapedConn]bool)}
+
+type shapedConn struct {
+	net.Conn
+	s    *shaper
+	up   *tokenBucket
+	down *tokenBucket
+	once sync.Once
+}
+
+// parseByteSize parses sizes like 512K, 20M or 1.5G (1024-based).
+func parseByteSize(s string) (int64, error) {
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+	multiplier := 1.0
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	case "T":
+		multiplier = 1 << 40
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * multiplier), nil
+}
+
+func (s *shaper) configure(upRate, downRate int64, fairShare bool, daily, monthly int64, policy, path string) error {
+	if policy != "pause" && policy != "close" {
+		return fmt.Errorf("unknown quota policy %q", policy)
+	}
+
+	s.upRate, s.downRate, s.fairShare = upRate, downRate, fairShare
+	if upRate > 0 {
+		s.up = newTokenBucket(upRate)
+	}
+	if downRate > 0 {
+		s.down = newTokenBucket(downRate)
+	}
+	s.dailyQuota, s.monthlyQuota, s.quotaPolicy, s.quotaPath = daily, monthly, policy, path
+	s.cond = sync.NewCond(&s.mu)
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &s.state)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to load quota state: %v", err)
+		}
+	}
+	s.mu.Lock()
+	s.rollOver(time.Now())
+	s.mu.Unlock()
+
+	if daily > 0 || monthly > 0 {
+		go s.maintain()
+	}
+	return nil
+}
+
+// rollOver resets the counters when a new day or month starts. Callers
+// hold s.mu.
+func (s *shaper) rollOver(now time.Time) {
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	if s.state.Day != day {
+		s.state.Day, s.state.DayBytes, s.dirty = day, 0, true
+	}
+	if s.state.Month != month {
+		s.state.Month, s.state.MonthBytes, s.dirty = month, 0, true
+	}
+
+	exhausted := (s.dailyQuota > 0 && s.state.DayBytes >= s.dailyQuota) ||
+		(s.monthlyQuota > 0 && s.state.MonthBytes >= s.monthlyQuota)
+	if exhausted == s.exhausted {
+		return
+	}
+	s.exhausted = exhausted
+	if !exhausted {
+		log.Println("Data quota available again, resuming tunnel")
+		s.cond.Broadcast()
+		return
+	}
+
+	log.Printf("Data quota exhausted (day %d/%d bytes, month %d/%d bytes), policy %s",
+		s.state.DayBytes, s.dailyQuota, s.state.MonthBytes, s.monthlyQuota, s.quotaPolicy)
+	if s.quotaPolicy == "close" {
+		for c := range s.conns {
+			c.Conn.Close()
+		}
+	}
+}
+
+// maintain saves the quota state and notices period changes.
+func (s *shaper) maintain() {
+	for {
+		time.Sleep(30 * time.Second)
+		s.mu.Lock()
+		s.rollOver(time.Now())
+		s.mu.Unlock()
+		s.save()
+	}
+}
+
+func (s *shaper) save() {
+	if s.quotaPath == "" {
+		return
+	}
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return
+	}
+	data, _ := json.MarshalIndent(s.state, "", "  ")
+	s.dirty = false
+	s.mu.Unlock()
+
+	tmp := s.quotaPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("Failed to save quota state: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, s.quotaPath); err != nil {
+		log.Printf("Failed to save quota state: %v", err)
+	}
+}
+
+func (s *shaper) account(n int) {
+	if s.dailyQuota == 0 && s.monthlyQuota == 0 {
+		return
+	}
+	s.mu.Lock()
+	s.state.DayBytes += int64(n)
+	s.state.MonthBytes += int64(n)
+	s.dirty = true
+	s.rollOver(time.Now())
+	s.mu.Unlock()
+}
+
+// waitQuota blocks while the quota is exhausted under the pause policy.
+func (s *shaper) waitQuota() error {
+	if s.dailyQuota == 0 && s.monthlyQuota == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.exhausted {
+		if s.quotaPolicy == "close" {
+			return fmt.Errorf("data quota exhausted")
+		}
+		s.cond.Wait()
+	}
+	return nil
+}
+
+// waitForQuota keeps the client disconnected while the quota is exhausted
+// under the close policy.
+func (s *shaper) waitForQuota() {
+	if s.quotaPolicy != "close" {
+		return
+	}
+	s.mu.Lock()
+	if s.exhausted {
+		log.Println("Data quota exhausted, staying disconnected until it resets")
+	}
+	for s.exhausted {
+		s.cond.Wait()
+	}
+	s.mu.Unlock()
+}
+
+// shapeConn wraps a connection to the relay: reads count as download,
+// writes as upload.
+func (s *shaper) shapeConn(c net.Conn) net.Conn {
+	sc := &shapedConn{Conn: c, s: s, up: s.up, down: s.down}
+
+	s.mu.Lock()
+	s.conns[sc] = true
+	if s.fairShare {
+		if s.upRate > 0 {
+			sc.up = newTokenBucket(s.upRate)
+		}
+		if s.downRate > 0 {
+			sc.down = newTokenBucket(s.downRate)
+		}
+		s.rebalance()
+	}
+	s.mu.Unlock()
+	return sc
+}
+
+// rebalance gives every open stream an equal share of the tunnel rate, at
+// least a byte per second so that the per-stream buckets keep limiting.
+// Callers hold s.mu.
+func (s *shaper) rebalance() {
+	n := int64(len(s.conns))
+	if n == 0 {
+		return
+	}
+	for c := range s.conns {
+		if c.up != nil && c.up != s.up {
+			c.up.setRate(max(s.upRate/n, 1))
+		}
+		if c.down != nil && c.down != s.down {
+			c.down.setRate(max(s.downRate/n, 1))
+		}
+	}
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	if err := c.s.waitQuota(); err != nil {
+		return 0, err
+	}
+	if c.down != nil && len(p) > maxShapedRead {
+		p = p[:maxShapedRead]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.s.bytesDown.Add(int64(n))
+		c.s.account(n)
+		if c.down != nil && c.down != c.s.down {
+			c.down.wait(n)
+		}
+		if c.s.down != nil {
+			c.s.down.wait(n)
+		}
+	}
+	return n, err
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		if err := c.s.waitQuota(); err != nil {
+			return written, err
+		}
+		chunk := len(p) - written
+		// The tunnel bucket may shrink the chunk, so the stream's share is
+		// charged for what is actually sent
+		if c.s.up != nil {
+			chunk = c.s.up.take(chunk)
+		}
+		if c.up != nil && c.up != c.s.up {
+			c.up.wait(chunk)
+		}
+		n, err := c.Conn.Write(p[written : written+chunk])
+		written += n
+		c.s.bytesUp.Add(int64(n))
+		c.s.account(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (c *shapedConn) Close() error {
+	c.once.Do(func() {
+		c.s.mu.Lock()
+		delete(c.s.conns, c)
+		if c.s.fairShare {
+			c.s.rebalance()
+		}
+		c.s.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+func (c *shapedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
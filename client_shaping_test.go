@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"testing"
+)
+
+// TestFairShareRates checks that streams keep a rate of their own when
+// there are more streams than bytes per second to share.
+func TestFairShareRates(t *testing.T) {
+	s := &shaper{conns: make(map[*shapedConn]bool)}
+	if err := s.configure(10, 0, true, 0, 0, "pause", ""); err != nil {
+		t.Fatal(err)
+	}
+	var conns []*shapedConn
+	for i := 0; i < 20; i++ {
+		a, _ := tcpPair(t)
+		conns = append(conns, s.shapeConn(a).(*shapedConn))
+	}
+	for i, c := range conns {
+		if c.up == s.up || c.up.rate != 1 {
+			t.Fatalf("stream %d has rate %v, want 1", i, c.up.rate)
+		}
+	}
+}
+
+// TestFairShareWrite checks that a write charges the stream's bucket with
+// the bytes sent.
+func TestFairShareWrite(t *testing.T) {
+	s := &shaper{conns: make(map[*shapedConn]bool)}
+	if err := s.configure(10<<20, 0, true, 0, 0, "pause", ""); err != nil {
+		t.Fatal(err)
+	}
+	a, b := tcpPair(t)
+	go io.Copy(io.Discard, b)
+	c := s.shapeConn(a).(*shapedConn)
+
+	const size = 100 * 1024
+	if n, err := c.Write(make([]byte, size)); n != size || err != nil {
+		t.Fatalf("wrote %d bytes, %v", n, err)
+	}
+	c.up.mu.Lock()
+	used := c.up.burst - c.up.tokens
+	c.up.mu.Unlock()
+	// The bucket refills while the test runs, by at most a few KiB
+	if used > size || used < size-16*1024 {
+		t.Errorf("stream bucket was charged %.0f bytes, want about %d", used, size)
+	}
+}
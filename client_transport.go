@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	transport      string
+	wsPath         string
+	relayProxyFlag string
+
+	// proxyLogged remembers the relays whose proxy has been logged.
+	proxyLogged sync.Map
+)
+
+// dialRelay connects to the relay, through a proxy when one applies, and
+// completes TLS with config. With -transport wss the tunnel then runs
+// inside a WebSocket on that connection.
+func dialRelay(relayAddr string, config *tls.Config) (net.Conn, error) {
+	raw, err := dialRelayConn(relayAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, _ := net.SplitHostPort(relayAddr)
+	if net.ParseIP(host) == nil && config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = host
+	}
+	conn := tls.Client(raw, config)
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	if transport != "wss" {
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+
+	ws, err := dialWebSocket(conn, relayAddr, wsPath)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ws, nil
+}
+
+// dialRelayConn opens the TCP connection to the relay, through the proxy
+// relayProxy picks for it.
+func dialRelayConn(relayAddr string) (net.Conn, error) {
+	proxyURL, err := relayProxy(relayAddr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return dialRelayTCP(relayAddr)
+	}
+	if _, seen := proxyLogged.LoadOrStore(relayAddr, true); !seen {
+		log.Printf("Connecting to relay %s through proxy %s", relayAddr, proxyURL.Redacted())
+	}
+	return dialProxy(proxyURL, relayAddr)
+}
+
+// relayProxy returns the proxy for reaching the relay at relayAddr, or nil
+// to connect directly. -relay-proxy wins over the environment.
+func relayProxy(relayAddr string) (*url.URL, error) {
+	if relayProxyFlag == "direct" {
+		return nil, nil
+	}
+	if relayProxyFlag != "" {
+		return parseProxyURL(relayProxyFlag)
+	}
+	return proxyFromEnv(relayAddr)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+var (
+	sessionMu sync.Mutex
+	session   *muxSession
+)
+
+// acceptTunnels runs a multiplexed session for each tunnel client; the
+// newest one serves the public requests.
+func acceptTunnels(listener net.Listener) {
+	for {
+		tunnelConn, err := listener.Accept()
+		if err != nil {
+			fmt.Println("Error accepting tunnel connection:", err)
+			return
+		}
+		fmt.Println("Tunnel client connected from", tunnelConn.RemoteAddr())
+
+		s := newMuxSession(tunnelConn, false, func(st *muxStream, _ []byte) {
+			st.reject("streams are opened by the server")
+		})
+		sessionMu.Lock()
+		previous := session
+		session = s
+		sessionMu.Unlock()
+		if previous != nil {
+			previous.Close()
+		}
+		go func() {
+			<-s.done
+			fmt.Println("Tunnel client disconnected:", s.Err())
+		}()
+	}
+}
+
+// handlePublicRequest passes one public request, and so one HTTP/2 stream,
+// through its own tunnel stream.
+func handlePublicRequest(w http.ResponseWriter, r *http.Request) {
+	sessionMu.Lock()
+	s := session
+	sessionMu.Unlock()
+	if s == nil {
+		http.Error(w, "No tunnel client connected", http.StatusBadGateway)
+		return
+	}
+
+	// Lets the client map redirects back to the public scheme
+	if r.TLS != nil {
+		r.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		r.Header.Set("X-Forwarded-Proto", "http")
+	}
+
+	payload, _ := json.Marshal(&muxRequest{Remote: r.RemoteAddr})
+	tunnelConn, err := s.open(payload)
+	if err != nil {
+		fmt.Println("Error opening tunnel stream:", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	// Forward request to tunnel client while the response comes back, so
+	// that streaming requests (gRPC) work in both directions
+	http.NewResponseController(w).EnableFullDuplex()
+	upgrade := r.Header.Get("Upgrade") != ""
+	written := make(chan error, 1)
+	go func() {
+		err := r.Write(tunnelConn)
+		if !upgrade {
+			tunnelConn.CloseWrite()
+		}
+		written <- err
+	}()
+	defer func() {
+		tunnelConn.Close()
+		r.Body.Close()
+		if err := <-written; err != nil {
+			fmt.Println("Error forwarding request:", err)
+		}
+	}()
+
+	// Read response from tunnel client
+	reader := bufio.NewReader(tunnelConn)
+	resp, err := http.ReadResponse(reader, r)
+	if err != nil {
+		fmt.Println("Error reading response:", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		proxyPublicUpgrade(w, resp, reader, tunnelConn)
+		return
+	}
+
+	// Copy headers
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+
+	// Set status code
+	w.WriteHeader(resp.StatusCode)
+
+	// Copy body, flushing as it arrives
+	rc := http.NewResponseController(w)
+	rc.Flush()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				fmt.Println("Error copying response body:", err)
+				return
+			}
+			rc.Flush()
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Println("Error copying response body:", err)
+			return
+		}
+	}
+
+	// Trailers are known once the body is read (gRPC sends its status there)
+	for k, v := range resp.Trailer {
+		w.Header()[http.TrailerPrefix+k] = v
+	}
+}
+
+// proxyPublicUpgrade hands the public connection over to the protocol the
+// local server switched to, e.g. WebSocket.
+func proxyPublicUpgrade(w http.ResponseWriter, resp *http.Response, tunnelReader *bufio.Reader, tunnelConn *muxStream) {
+	publicConn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		fmt.Println("Error upgrading connection:", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer publicConn.Close()
+
+	fmt.Fprintf(buffered, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(buffered)
+	buffered.WriteString("\r\n")
+	if err := buffered.Flush(); err != nil {
+		return
+	}
+	go func() {
+		io.Copy(tunnelConn, buffered.Reader)
+		tunnelConn.CloseWrite()
+	}()
+	io.Copy(publicConn, tunnelReader)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+)
+
+const localAddr = "localhost:5000"
+
+var (
+	local = flag.String("local", localAddr, "Local HTTP server")
+
+	// rewrite holds the -rewrite-config rules, nil without any.
+	rewrite *httpRewrite
+	// routes picks the local server per request with -routes.
+	routes *routeTable
+
+	// Redirects go back to the public client instead of being followed.
+	localClient = &http.Client{CheckRedirect: noRedirects}
+	grpcClient  = &http.Client{Transport: newH2CTransport(), CheckRedirect: noRedirects}
+)
+
+func noRedirects(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// handleRequest serves one request on its own tunnel stream.
+func handleRequest(conn *muxStream, _ []byte) {
+	defer conn.Close()
+	if err := conn.accept(); err != nil {
+		return
+	}
+
+	// Read request from server
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		if err != io.EOF {
+			fmt.Println("Error reading request:", err)
+		}
+		return
+	}
+
+	target, rw := *local, rewrite
+	if routes != nil {
+		route, matched := routes.match(req.URL.Path)
+		if route == nil {
+			writeStatus(conn, http.StatusNotFound)
+			return
+		}
+		target, rw = route.Target, route.rewriteFor(matched)
+	}
+	var scope *rewriteScope
+	if rw != nil {
+		var ok bool
+		if scope, ok = rw.rewriteRequest(req, target); !ok {
+			writeStatus(conn, http.StatusNotFound)
+			return
+		}
+	}
+
+	// Forward request to local server
+	localReq, err := http.NewRequest(req.Method, "http://"+target+req.URL.RequestURI(), req.Body)
+	if err != nil {
+		fmt.Println("Error creating local request:", err)
+		return
+	}
+	localReq.Header = req.Header
+	localReq.ContentLength = req.ContentLength
+	localReq.Trailer = req.Trailer
+	// The public Host, unless the rewrite rules set another
+	localReq.Host = req.Host
+
+	client := localClient
+	if isGRPC(req) {
+		client = grpcClient
+	}
+	resp, err := client.Do(localReq)
+	if err != nil {
+		fmt.Println("Error forwarding request:", err)
+		writeStatus(conn, http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if scope != nil {
+		scope.rewriteResponse(resp)
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		proxyUpgrade(conn, reader, req, resp)
+		return
+	}
+
+	// Send response back to server
+	err = writeResponse(conn, req, resp)
+	if err != nil {
+		fmt.Println("Error writing response:", err)
+		return
+	}
+	conn.CloseWrite()
+}
+
+// writeStatus answers with an empty response.
+func writeStatus(conn *muxStream, code int) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code))
+	conn.CloseWrite()
+}
+
+// proxyUpgrade passes the response of a protocol switch, e.g. to
+// WebSocket, and then the traffic in both directions.
+func proxyUpgrade(conn *muxStream, reader *bufio.Reader, req *http.Request, resp *http.Response) {
+	upgraded, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		writeStatus(conn, http.StatusBadGateway)
+		return
+	}
+	if err := writeResponse(conn, req, resp); err != nil {
+		fmt.Println("Error writing response:", err)
+		return
+	}
+	go func() {
+		io.Copy(upgraded, reader)
+		upgraded.Close()
+	}()
+	io.Copy(conn, upgraded)
+	upgraded.Close()
+	conn.CloseWrite()
+}
+
+// writeResponse sends resp chunked, so that its body streams and its
+// trailers follow it. Responses without a body keep their headers as they
+// are.
+func writeResponse(w io.Writer, req *http.Request, resp *http.Response) error {
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Header.Del("Connection")
+		resp.Header.Del("Keep-Alive")
+	}
+	bodyless := req.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified || resp.StatusCode < 200
+	if !bodyless {
+		resp.Header.Del("Content-Length")
+		resp.Header.Set("Transfer-Encoding", "chunked")
+	}
+	if _, err := fmt.Fprintf(w, "HTTP/1.1 %03d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode)); err != nil {
+		return err
+	}
+	if err := resp.Header.Write(w); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, "\r\n"); err != nil {
+		return err
+	}
+	if bodyless {
+		return nil
+	}
+
+	chunked := httputil.NewChunkedWriter(w)
+	if _, err := io.Copy(chunked, resp.Body); err != nil {
+		return err
+	}
+	if err := chunked.Close(); err != nil {
+		return err
+	}
+	// The trailers are complete now that the body is read
+	if err := resp.Trailer.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// grpcEcho is a gRPC-style bidirectional streaming handler: it sends every
+// length-prefixed message back as soon as it arrives and ends with the
+// status in the trailers.
+func grpcEcho(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	rc.Flush()
+
+	count := 0
+	for {
+		msg, err := readGRPCMessage(r.Body)
+		if err != nil {
+			break
+		}
+		w.Write(msg)
+		rc.Flush()
+		count++
+	}
+	w.Header().Set("Grpc-Status", "0")
+	w.Header().Set("Grpc-Message", fmt.Sprintf("echoed %d", count))
+}
+
+// readGRPCMessage reads one message with its 5-byte prefix.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	msg := make([]byte, 5)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	msg = append(msg, make([]byte, binary.BigEndian.Uint32(msg[1:]))...)
+	if _, err := io.ReadFull(r, msg[5:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func grpcMessage(payload string) []byte {
+	msg := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(payload)))
+	return append(msg, payload...)
+}
+
+// serveH2C serves handler with HTTP/1.1 and h2c on a loopback port.
+func serveH2C(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler, Protocols: new(http.Protocols)}
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+// startHTTPRelay runs the relay with a tunnel client connected to it and
+// returns the relay's public address.
+func startHTTPRelay(t *testing.T) string {
+	t.Helper()
+	sessionMu.Lock()
+	session = nil
+	sessionMu.Unlock()
+	tunnelListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tunnelListener.Close() })
+	go acceptTunnels(tunnelListener)
+	public := serveH2C(t, http.HandlerFunc(handlePublicRequest))
+
+	conn, err := net.Dial("tcp", tunnelListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newMuxSession(conn, true, handleRequest)
+	t.Cleanup(func() { client.Close() })
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		sessionMu.Lock()
+		connected := session != nil
+		sessionMu.Unlock()
+		if connected {
+			return public
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel client did not connect")
+		}
+	}
+}
+
+// TestRelayGRPCStream drives a gRPC-style bidirectional stream from an h2c
+// client through the relay, the multiplexed tunnel and the tunnel client to
+// a local h2c echo server.
+func TestRelayGRPCStream(t *testing.T) {
+	*local = serveH2C(t, http.HandlerFunc(grpcEcho))
+	public := startHTTPRelay(t)
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	defer transport.CloseIdleConnections()
+	body, send := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, "http://"+public+"/echo.Echo/Stream", body)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := (&http.Client{Transport: transport}).Do(req)
+		results <- result{resp, err}
+	}()
+
+	// Each echo must come back before the next message is sent, so the
+	// request and response streams are open at the same time
+	const messages = 5
+	if _, err := send.Write(grpcMessage("message 0")); err != nil {
+		t.Fatal(err)
+	}
+	var r result
+	select {
+	case r = <-results:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no response headers while the request streams")
+	}
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	defer r.resp.Body.Close()
+	if r.resp.StatusCode != http.StatusOK || r.resp.ProtoMajor != 2 {
+		t.Fatalf("got %s over %s, want 200 over HTTP/2", r.resp.Status, r.resp.Proto)
+	}
+
+	for i := 0; i < messages; i++ {
+		if i > 0 {
+			if _, err := send.Write(grpcMessage(fmt.Sprintf("message %d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		echo, err := readGRPCMessage(r.resp.Body)
+		if err != nil {
+			t.Fatalf("reading echo %d: %v", i, err)
+		}
+		if want := grpcMessage(fmt.Sprintf("message %d", i)); !bytes.Equal(echo, want) {
+			t.Fatalf("echo %d is %q, want %q", i, echo, want)
+		}
+	}
+	send.Close()
+	if rest, err := io.ReadAll(r.resp.Body); err != nil || len(rest) > 0 {
+		t.Fatalf("after the last echo got %q, %v", rest, err)
+	}
+
+	if got := r.resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("Grpc-Status trailer is %q, want 0", got)
+	}
+	if got, want := r.resp.Trailer.Get("Grpc-Message"), fmt.Sprintf("echoed %d", messages); got != want {
+		t.Errorf("Grpc-Message trailer is %q, want %q", got, want)
+	}
+}
+
+// TestRelayHost checks the Host header the local server gets: the public
+// one unless the rewrite rules ask for the target's or a name of their own.
+func TestRelayHost(t *testing.T) {
+	*local = serveH2C(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	}))
+	public := startHTTPRelay(t)
+	defer func(saved *httpRewrite) { rewrite = saved }(rewrite)
+
+	for _, tc := range []struct {
+		host string
+		want string
+	}{
+		{"", "public.example.com"},
+		{"target", *local},
+		{"app.internal", "app.internal"},
+	} {
+		rewrite = nil
+		if tc.host != "" {
+			rewrite = &httpRewrite{Host: tc.host}
+		}
+		req, _ := http.NewRequest(http.MethodGet, "http://"+public+"/", nil)
+		req.Host = "public.example.com"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(got) != tc.want {
+			t.Errorf("host %q: local server got Host %q, want %q", tc.host, got, tc.want)
+		}
+	}
+}
+
+// TestRelayRoutesHost checks that routes pass the same Host as the TCP-mode
+// router does for the same routes file.
+func TestRelayRoutesHost(t *testing.T) {
+	path, target := writeHostRoutes(t)
+	table, err := loadRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved *routeTable) { routes = saved }(routes)
+	routes = table
+	public := startHTTPRelay(t)
+
+	if got := getHost(t, public, "/public"); got != "public.example.com" {
+		t.Errorf("route without host rule: Host %q, want public.example.com", got)
+	}
+	if got := getHost(t, public, "/target"); got != target {
+		t.Errorf(`route with "host": "target": Host %q, want %q`, got, target)
+	}
+}
@@ -0,0 +1,753 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// acmeClient speaks just enough RFC 8555 to order single-name certificates
+// with HTTP-01 or TLS-ALPN-01 challenges.
+type acmeClient struct {
+	directoryURL string
+	email        string
+	challenge    string
+	http         *http.Client
+	key          *ecdsa.PrivateKey
+
+	mu        sync.Mutex
+	directory struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+		NewOrder   string `json:"newOrder"`
+	}
+	nonce string
+	kid   string
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+type acmeOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+	Error          *acmeProblem
+}
+
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []struct {
+		Type   string `json:"type"`
+		URL    string `json:"url"`
+		Token  string `json:"token"`
+		Status string `json:"status"`
+		Error  *acmeProblem
+	} `json:"challenges"`
+}
+
+// acmeIdentifierOID marks TLS-ALPN-01 validation certificates (RFC 8737).
+var acmeIdentifierOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+const acmeALPNProto = "acme-tls/1"
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (c *acmeClient) jwk() map[string]string {
+	size := (c.key.Curve.Params().BitSize + 7) / 8
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   b64(c.key.X.FillBytes(make([]byte, size))),
+		"y":   b64(c.key.Y.FillBytes(make([]byte, size))),
+	}
+}
+
+// thumbprint is the RFC 7638 thumbprint used in key authorizations.
+func (c *acmeClient) thumbprint() string {
+	jwk := c.jwk()
+	canonical := fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk["crv"], jwk["kty"], jwk["x"], jwk["y"])
+	sum := sha256.Sum256([]byte(canonical))
+	return b64(sum[:])
+}
+
+func (c *acmeClient) keyAuthorization(token string) string {
+	return token + "." + c.thumbprint()
+}
+
+func (c *acmeClient) init() error {
+	resp, err := c.http.Get(c.directoryURL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch ACME directory: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch ACME directory: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&c.directory); err != nil {
+		return fmt.Errorf("invalid ACME directory: %v", err)
+	}
+
+	payload := map[string]any{"termsOfServiceAgreed": true}
+	if c.email != "" {
+		payload["contact"] = []string{"mailto:" + c.email}
+	}
+	resp, _, err = c.post(c.directory.NewAccount, payload)
+	if err != nil {
+		return fmt.Errorf("failed to register ACME account: %v", err)
+	}
+	c.kid = resp.Header.Get("Location")
+	log.Printf("ACME account %s", c.kid)
+	return nil
+}
+
+func (c *acmeClient) fetchNonce() (string, error) {
+	c.mu.Lock()
+	nonce := c.nonce
+	c.nonce = ""
+	c.mu.Unlock()
+	if nonce != "" {
+		return nonce, nil
+	}
+
+	resp, err := c.http.Head(c.directory.NewNonce)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if nonce = resp.Header.Get("Replay-Nonce"); nonce == "" {
+		return "", fmt.Errorf("no nonce from %s", c.directory.NewNonce)
+	}
+	return nonce, nil
+}
+
+// post sends a JWS signed request; a nil payload is a POST-as-GET.
+func (c *acmeClient) post(url string, payload any) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		resp, body, err := c.postOnce(url, payload)
+		if err == nil {
+			return resp, body, nil
+		}
+		if problem, ok := err.(*acmeProblem); ok && strings.HasSuffix(problem.Type, ":badNonce") && attempt < 3 {
+			continue
+		}
+		return nil, nil, err
+	}
+}
+
+func (c *acmeClient) postOnce(url string, payload any) (*http.Response, []byte, error) {
+	nonce, err := c.fetchNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	protected := map[string]any{"alg": "ES256", "nonce": nonce, "url": url}
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		protected["jwk"] = c.jwk()
+	}
+	header, _ := json.Marshal(protected)
+	body := ""
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		body = b64(data)
+	}
+
+	signingInput := b64(header) + "." + body
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	jws, _ := json.Marshal(map[string]string{"protected": b64(header), "payload": body, "signature": b64(signature)})
+
+	resp, err := c.http.Post(url, "application/jose+json", bytes.NewReader(jws))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+		c.mu.Lock()
+		c.nonce = nonce
+		c.mu.Unlock()
+	}
+	if resp.StatusCode >= 400 {
+		problem := &acmeProblem{}
+		if json.Unmarshal(data, problem) != nil || problem.Type == "" {
+			problem.Detail = fmt.Sprintf("%s: %s", resp.Status, data)
+		}
+		return nil, nil, problem
+	}
+	return resp, data, nil
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("%s (%s)", p.Detail, p.Type)
+}
+
+// poll fetches url until its status leaves pending/processing.
+func (c *acmeClient) poll(url string, v any, status func() string) error {
+	deadline := time.Now().Add(2 * time.Minute)
+	for {
+		resp, data, err := c.post(url, nil)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			return err
+		}
+		if s := status(); s != "pending" && s != "processing" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %s", url)
+		}
+		wait := time.Second
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 && seconds < 30 {
+			wait = time.Duration(seconds) * time.Second
+		}
+		time.Sleep(wait)
+	}
+}
+
+// obtain orders a certificate for name; m serves the challenge responses
+// while the CA validates them.
+func (c *acmeClient) obtain(name string, m *certManager) (*tls.Certificate, error) {
+	resp, data, err := c.post(c.directory.NewOrder, map[string]any{
+		"identifiers": []map[string]string{{"type": "dns", "value": name}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create order: %v", err)
+	}
+	orderURL := resp.Header.Get("Location")
+	order := &acmeOrder{}
+	if err := json.Unmarshal(data, order); err != nil {
+		return nil, err
+	}
+
+	for _, authzURL := range order.Authorizations {
+		if err := c.authorize(authzURL, m); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, data, err = c.post(order.Finalize, map[string]string{"csr": b64(csr)}); err != nil {
+		return nil, fmt.Errorf("failed to finalize order: %v", err)
+	}
+	if err := json.Unmarshal(data, order); err != nil {
+		return nil, err
+	}
+	if order.Status != "valid" {
+		if err := c.poll(orderURL, order, func() string { return order.Status }); err != nil {
+			return nil, err
+		}
+	}
+	if order.Status != "valid" {
+		return nil, fmt.Errorf("order for %s is %s", name, order.Status)
+	}
+
+	_, chain, err := c.post(order.Certificate, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(chain, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate from CA: %v", err)
+	}
+	m.store(name, chain, keyPEM)
+	return &cert, nil
+}
+
+func (c *acmeClient) authorize(url string, m *certManager) error {
+	authz := &acmeAuthorization{}
+	if _, data, err := c.post(url, nil); err != nil {
+		return fmt.Errorf("failed to fetch authorization: %v", err)
+	} else if err := json.Unmarshal(data, authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+
+	name := authz.Identifier.Value
+	for _, ch := range authz.Challenges {
+		if ch.Type != c.challenge {
+			continue
+		}
+		keyAuth := c.keyAuthorization(ch.Token)
+		switch ch.Type {
+		case "http-01":
+			m.setHTTPToken(ch.Token, keyAuth)
+			defer m.setHTTPToken(ch.Token, "")
+		case "tls-alpn-01":
+			cert, err := alpnChallengeCert(name, keyAuth)
+			if err != nil {
+				return err
+			}
+			m.setALPNCert(name, cert)
+			defer m.setALPNCert(name, nil)
+		}
+
+		if _, _, err := c.post(ch.URL, map[string]any{}); err != nil {
+			return fmt.Errorf("failed to accept %s challenge: %v", ch.Type, err)
+		}
+		if err := c.poll(url, authz, func() string { return authz.Status }); err != nil {
+			return err
+		}
+		if authz.Status != "valid" {
+			for _, ch := range authz.Challenges {
+				if ch.Error != nil {
+					return fmt.Errorf("%s challenge for %s failed: %v", ch.Type, name, ch.Error)
+				}
+			}
+			return fmt.Errorf("authorization for %s is %s", name, authz.Status)
+		}
+		return nil
+	}
+	return fmt.Errorf("CA offers no %s challenge for %s", c.challenge, name)
+}
+
+// alpnChallengeCert builds the self-signed TLS-ALPN-01 certificate that
+// carries the key authorization digest.
+func alpnChallengeCert(name, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(keyAuth))
+	value, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(time.Now().UnixNano()),
+		Subject:         pkix.Name{CommonName: name},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		DNSNames:        []string{name},
+		ExtraExtensions: []pkix.Extension{{Id: acmeIdentifierOID, Critical: true, Value: value}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// certManager hands out certificates for relay-terminated hostnames: files
+// given with -tls-cert first, then the ACME cache, then a new order.
+type certManager struct {
+	cacheDir string
+	domains  []string
+	acme     *acmeClient
+
+	mu         sync.Mutex
+	static     []*tls.Certificate
+	certs      map[string]*tls.Certificate
+	requests   map[string]*certRequest
+	httpTokens map[string]string
+	alpnCerts  map[string]*tls.Certificate
+}
+
+var relayCerts *certManager
+
+func newCertManager(certPairs, cacheDir, domains string) (*certManager, error) {
+	m := &certManager{
+		cacheDir:   cacheDir,
+		certs:      make(map[string]*tls.Certificate),
+		requests:   make(map[string]*certRequest),
+		httpTokens: make(map[string]string),
+		alpnCerts:  make(map[string]*tls.Certificate),
+	}
+	for _, d := range strings.Split(domains, ",") {
+		if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+			m.domains = append(m.domains, strings.TrimPrefix(d, "*."))
+		}
+	}
+
+	for _, pair := range strings.Split(certPairs, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		certFile, keyFile, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid -tls-cert %q, expected cert.pem:key.pem", pair)
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %v", certFile, err)
+		}
+		m.static = append(m.static, &cert)
+	}
+
+	if cacheDir != "" {
+		if err := os.MkdirAll(cacheDir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create certificate cache: %v", err)
+		}
+	}
+	return m, nil
+}
+
+// enableACME loads or creates the account key and registers it.
+func (m *certManager) enableACME(directoryURL, email, challenge, caFile string) error {
+	if challenge != "http-01" && challenge != "tls-alpn-01" {
+		return fmt.Errorf("unknown ACME challenge %q", challenge)
+	}
+	if m.cacheDir == "" {
+		return fmt.Errorf("ACME needs a certificate cache directory")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile != "" {
+		// Private CAs and Pebble serve their API with their own root
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read ACME CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	keyPath := filepath.Join(m.cacheDir, "acme_account.key")
+	var key *ecdsa.PrivateKey
+	if data, err := os.ReadFile(keyPath); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return fmt.Errorf("invalid ACME account key %s", keyPath)
+		}
+		if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return fmt.Errorf("invalid ACME account key %s: %v", keyPath, err)
+		}
+	} else {
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return err
+		}
+		der, _ := x509.MarshalECPrivateKey(key)
+		if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return fmt.Errorf("failed to save ACME account key: %v", err)
+		}
+	}
+
+	m.acme = &acmeClient{
+		directoryURL: directoryURL,
+		email:        email,
+		challenge:    challenge,
+		http:         &http.Client{Timeout: 30 * time.Second, Transport: transport},
+		key:          key,
+	}
+	if err := m.acme.init(); err != nil {
+		return err
+	}
+	go m.renewLoop()
+	return nil
+}
+
+func (m *certManager) allowed(name string) bool {
+	for _, d := range m.domains {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return len(m.domains) == 0
+}
+
+func (m *certManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return nil, fmt.Errorf("no server name")
+	}
+
+	for _, cert := range m.static {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+
+	if cert := m.cached(name); cert != nil {
+		return cert, nil
+	}
+	if m.acme == nil || !m.allowed(name) {
+		return nil, fmt.Errorf("no certificate for %s", name)
+	}
+
+	req, err := m.request(name)
+	if err != nil {
+		return nil, err
+	}
+	// Orders usually finish within seconds. Wait that long so that the first
+	// visitor gets the certificate, but well within the handshake deadline.
+	timer := time.NewTimer(acmeHandshakeWait)
+	defer timer.Stop()
+	select {
+	case <-req.done:
+	case <-timer.C:
+		return nil, fmt.Errorf("certificate for %s is being requested", name)
+	}
+	if cert := m.cached(name); cert != nil {
+		return cert, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return nil, fmt.Errorf("failed to obtain certificate for %s: %v", name, req.err)
+}
+
+// certRequest tracks the certificate orders of a name, so that handshakes
+// never run them and failed ones are not repeated at once.
+type certRequest struct {
+	done     chan struct{} // closed when the running order ends
+	running  bool
+	failures int
+	retryAt  time.Time
+	err      error
+}
+
+const (
+	acmeHandshakeWait = 10 * time.Second
+	acmeRetryMin      = 5 * time.Minute
+	acmeRetryMax      = 24 * time.Hour
+)
+
+// request starts an order for name in the background. It fails while one is
+// running or while the last one failed too recently.
+func (m *certManager) request(name string) (*certRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	req := m.requests[name]
+	if req == nil {
+		req = &certRequest{}
+		m.requests[name] = req
+	}
+	if req.running {
+		return nil, fmt.Errorf("certificate for %s is being requested", name)
+	}
+	if time.Now().Before(req.retryAt) {
+		return nil, fmt.Errorf("certificate for %s failed, next attempt after %s: %v", name, req.retryAt.Format(time.RFC3339), req.err)
+	}
+	req.running = true
+	req.done = make(chan struct{})
+	go m.runRequest(name, req)
+	return req, nil
+}
+
+func (m *certManager) runRequest(name string, req *certRequest) {
+	defer close(req.done)
+	log.Printf("Requesting certificate for %s", name)
+	cert, err := m.acme.obtain(name, m)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	req.running = false
+	req.err = err
+	if err != nil {
+		// Back off exponentially, CAs limit failed validations per hour
+		backoff := acmeRetryMax
+		if req.failures < 10 {
+			backoff = min(acmeRetryMin<<req.failures, acmeRetryMax)
+		}
+		req.failures++
+		req.retryAt = time.Now().Add(backoff)
+		log.Printf("Failed to obtain certificate for %s, next attempt in %s: %v", name, backoff, err)
+		return
+	}
+	req.failures = 0
+	req.retryAt = time.Time{}
+	m.certs[name] = cert
+	log.Printf("Obtained certificate for %s, valid until %s", name, cert.Leaf.NotAfter.Format(time.RFC3339))
+}
+
+// cached returns the certificate for name from memory or the disk cache.
+func (m *certManager) cached(name string) *tls.Certificate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cert := m.certs[name]; cert != nil {
+		return cert
+	}
+	if m.cacheDir == "" {
+		return nil
+	}
+	base := filepath.Join(m.cacheDir, name)
+	cert, err := tls.LoadX509KeyPair(base+".crt", base+".key")
+	if err != nil || time.Until(cert.Leaf.NotAfter) < renewBefore(cert.Leaf) {
+		return nil
+	}
+	m.certs[name] = &cert
+	return &cert
+}
+
+func (m *certManager) store(name string, chain, key []byte) {
+	base := filepath.Join(m.cacheDir, name)
+	if err := os.WriteFile(base+".key", key, 0600); err != nil {
+		log.Printf("Failed to cache certificate for %s: %v", name, err)
+		return
+	}
+	if err := os.WriteFile(base+".crt", chain, 0644); err != nil {
+		log.Printf("Failed to cache certificate for %s: %v", name, err)
+	}
+}
+
+// renewBefore is a third of the certificate lifetime, like common ACME
+// clients use.
+func renewBefore(leaf *x509.Certificate) time.Duration {
+	return leaf.NotAfter.Sub(leaf.NotBefore) / 3
+}
+
+func (m *certManager) renewLoop() {
+	for {
+		time.Sleep(time.Hour)
+
+		m.mu.Lock()
+		var due []string
+		for name, cert := range m.certs {
+			if time.Until(cert.Leaf.NotAfter) < renewBefore(cert.Leaf) {
+				due = append(due, name)
+			}
+		}
+		m.mu.Unlock()
+
+		for _, name := range due {
+			log.Printf("Renewing certificate for %s", name)
+			if req, err := m.request(name); err == nil {
+				<-req.done
+			}
+		}
+	}
+}
+
+func (m *certManager) setHTTPToken(token, keyAuth string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if keyAuth == "" {
+		delete(m.httpTokens, token)
+	} else {
+		m.httpTokens[token] = keyAuth
+	}
+}
+
+func (m *certManager) setALPNCert(name string, cert *tls.Certificate) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cert == nil {
+		delete(m.alpnCerts, name)
+	} else {
+		m.alpnCerts[name] = cert
+	}
+}
+
+func (m *certManager) alpnCert(name string) *tls.Certificate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.alpnCerts[strings.ToLower(name)]
+}
+
+// serveHTTPChallenge answers HTTP-01 challenges on port 80 and sends
+// everything else to HTTPS.
+func (m *certManager) serveHTTPChallenge(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+	if !ok {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if sniPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(sniPort))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusFound)
+		return
+	}
+	m.mu.Lock()
+	keyAuth := m.httpTokens[token]
+	m.mu.Unlock()
+	if keyAuth == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, keyAuth)
+}
+
+// terminateTLS completes the handshake for a relay-terminated hostname,
+// or for a TLS-ALPN-01 validation, in which case it returns nil.
+func (m *certManager) terminateTLS(stream net.Conn, protos []string) (net.Conn, error) {
+	config := &tls.Config{GetCertificate: m.getCertificate, NextProtos: []string{"http/1.1"}}
+	if slices.Contains(protos, acmeALPNProto) {
+		config = &tls.Config{
+			NextProtos: []string{acmeALPNProto},
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if cert := m.alpnCert(hello.ServerName); cert != nil {
+					return cert, nil
+				}
+				return nil, fmt.Errorf("no TLS-ALPN-01 challenge for %s", hello.ServerName)
+			},
+		}
+	}
+
+	conn := tls.Server(stream, config)
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	if conn.ConnectionState().NegotiatedProtocol == acmeALPNProto {
+		conn.Close()
+		return nil, nil
+	}
+	return conn, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestACMEFailedOrders checks that handshakes do not wait for a running
+// order and that a failed order is not repeated by the next handshake.
+func TestACMEFailedOrders(t *testing.T) {
+	var orders atomic.Int32
+	release := make(chan struct{})
+	ca := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		if r.URL.Path != "/new-order" {
+			return
+		}
+		orders.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"type": "urn:ietf:params:acme:error:rateLimited", "detail": "too many failed authorizations"}`))
+	}))
+	defer ca.Close()
+
+	m, err := newCertManager("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.acme = &acmeClient{http: ca.Client(), key: key, kid: ca.URL + "/account"}
+	m.acme.directory.NewNonce = ca.URL + "/new-nonce"
+	m.acme.directory.NewOrder = ca.URL + "/new-order"
+	hello := &tls.ClientHelloInfo{ServerName: "app.example.com"}
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := m.getCertificate(hello)
+		first <- err
+	}()
+	for deadline := time.Now().Add(5 * time.Second); orders.Load() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no order placed")
+		}
+	}
+
+	start := time.Now()
+	if _, err := m.getCertificate(hello); err == nil || !strings.Contains(err.Error(), "being requested") {
+		t.Fatalf("handshake during the order: %v", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("handshake during the order took %s", waited)
+	}
+
+	close(release)
+	if err := <-first; err == nil || !strings.Contains(err.Error(), "too many failed authorizations") {
+		t.Fatalf("first handshake: %v", err)
+	}
+	if _, err := m.getCertificate(hello); err == nil || !strings.Contains(err.Error(), "next attempt after") {
+		t.Fatalf("handshake after the failure: %v", err)
+	}
+	if n := orders.Load(); n != 1 {
+		t.Fatalf("%d orders placed, want 1", n)
+	}
+}
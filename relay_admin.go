@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// adminMux serves the relay's admin API; features register their handlers
+// on it before startAdminAPI is called.
+var adminMux = http.NewServeMux()
+
+// startAdminAPI serves adminMux on addr. With a token every request needs
+// "Authorization: Bearer <token>"; without one only loopback binds are
+// allowed. Browsers may not send it requests from other sites either way.
+func startAdminAPI(addr, token string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid -admin address %q: %v", addr, err)
+	}
+	if ip := net.ParseIP(host); token == "" && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("-admin %s is reachable from other hosts and needs -admin-token", addr)
+	}
+
+	adminMux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeCompressionMetrics(w)
+	})
+
+	handler := http.NewCrossOriginProtection().Handler(adminMux)
+	if token != "" {
+		handler = requireAdminToken(token, handler)
+	}
+	log.Printf("Admin API listening on %s", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, handler); err != nil {
+			log.Printf("Admin API error: %v", err)
+		}
+	}()
+	return nil
+}
+
+func requireAdminToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ssl_relay admin"`)
+			http.Error(w, "admin token required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
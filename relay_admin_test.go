@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAdminAPIAuth checks that the admin API needs a token off loopback,
+// checks it, and refuses requests browsers send from other sites.
+func TestAdminAPIAuth(t *testing.T) {
+	for _, addr := range []string{":4041", "0.0.0.0:4041", "192.0.2.1:4041", "relay.example.com:4041"} {
+		if err := startAdminAPI(addr, ""); err == nil || !strings.Contains(err.Error(), "-admin-token") {
+			t.Errorf("%s without a token: %v, want a refusal", addr, err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	if err := startAdminAPI(addr, "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(method, token string, header http.Header) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://"+addr+"/metrics", nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			resp, err := http.DefaultClient.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				return resp.StatusCode
+			}
+			if time.Now().After(deadline) {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		token  string
+		header http.Header
+		want   int
+	}{
+		{"no token", http.MethodGet, "", nil, http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "guess", nil, http.StatusUnauthorized},
+		{"token", http.MethodGet, "s3cret", nil, http.StatusOK},
+		{"cross-site POST", http.MethodPost, "s3cret", http.Header{"Sec-Fetch-Site": {"cross-site"}}, http.StatusForbidden},
+		{"cross-origin POST", http.MethodPost, "s3cret", http.Header{"Origin": {"https://evil.example"}}, http.StatusForbidden},
+		{"curl POST", http.MethodPost, "s3cret", nil, http.StatusOK},
+	} {
+		if got := request(tc.method, tc.token, tc.header); got != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
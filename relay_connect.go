@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+func handleConnect(conn net.Conn, clientIP net.IP, hello *tunnelHello) {
+	dest := hello.Connect
+	target, reply := dialDestination(dest)
+	if target != nil {
+		reply.Compression = negotiateCompression(hello.Compression)
+	}
+	if err := writeReply(conn, clientIP, 0, reply); err != nil {
+		log.Printf("Failed to send response to %s: %v", clientIP, err)
+		if target != nil {
+			target.Close()
+		}
+		return
+	}
+	if target == nil {
+		log.Printf("Connect from %s to %s failed: %s", clientIP, dest, reply.Error)
+		return
+	}
+	defer target.Close()
+
+	log.Printf("Client %s connected to %s", clientIP, dest)
+	if reply.Compression != "" {
+		conn = newCompressedConn(conn)
+	}
+	relayTraffic(conn, target)
+}
+
+func dialDestination(dest string) (net.Conn, *tunnelReply) {
+	host, portStr, err := net.SplitHostPort(dest)
+	port, _ := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, &tunnelReply{Error: "invalid destination " + dest, Code: "failed"}
+	}
+
+	// Resolve first so that CIDR rules apply to hostnames too, and dial the
+	// address that was checked rather than resolving again.
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, &tunnelReply{Error: err.Error(), Code: "unreachable"}
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		if !destAllowed.allows(host, ip, port) {
+			continue
+		}
+		target, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), portStr), 10*time.Second)
+		if err == nil {
+			return target, &tunnelReply{}
+		}
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		return nil, &tunnelReply{Error: "destination " + dest + " not allowed", Code: "denied"}
+	}
+	code := "unreachable"
+	if errors.Is(lastErr, syscall.ECONNREFUSED) {
+		code = "refused"
+	}
+	return nil, &tunnelReply{Error: lastErr.Error(), Code: code}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// enrollToken is a one-time bootstrap token; only its hash is stored.
+type enrollToken struct {
+	Hash    string
+	Name    string
+	Expires time.Time
+	Used    bool
+}
+
+// issuedCert records a client certificate signed by the enrollment CA.
+// Its thumbprint is allowed on the tunnel listener until it expires or is
+// revoked. Assigned marks names that come from the token rather than the
+// client's request; only those can be revoked by name.
+type issuedCert struct {
+	Thumbprint string
+	Serial     string
+	Name       string
+	Assigned   bool
+	NotAfter   time.Time
+	Revoked    bool
+	RevokedAt  time.Time `json:",omitzero"`
+}
+
+type enrollState struct {
+	Tokens []*enrollToken
+	Certs  []*issuedCert
+}
+
+type enrollService struct {
+	ca       tls.Certificate
+	validity time.Duration
+	path     string
+
+	mu       sync.Mutex
+	state    enrollState
+	sessions map[string]map[net.Conn]bool
+}
+
+var enrollment *enrollService
+
+func newEnrollService(caCertPath, caKeyPath, path string, validity time.Duration) (*enrollService, error) {
+	ca, err := tls.LoadX509KeyPair(caCertPath, caKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load enrollment CA: %v", err)
+	}
+	if !ca.Leaf.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", caCertPath)
+	}
+
+	s := &enrollService{ca: ca, validity: validity, path: path, sessions: make(map[string]map[net.Conn]bool)}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &s.state); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return s, nil
+}
+
+// start serves enrollment and renewal over TLS with the relay certificate.
+// Renewals authenticate with the client certificate being renewed.
+func (s *enrollService) start(addr string, cert tls.Certificate) error {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.ca.Leaf)
+	listener, err := tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/enroll", s.handleEnroll)
+	mux.HandleFunc("/renew", s.handleRenew)
+	adminMux.HandleFunc("/enroll/tokens", s.handleTokens)
+	adminMux.HandleFunc("/enroll/certs", s.handleCerts)
+	adminMux.HandleFunc("/enroll/revoke", s.handleRevoke)
+
+	log.Printf("Certificate enrollment listening on %s", addr)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("Enrollment server error: %v", err)
+		}
+	}()
+	return nil
+}
+
+// save writes the state through a temporary file; callers hold s.mu.
+func (s *enrollService) save() error {
+	data, err := json.MarshalIndent(&s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// allowed reports whether thumbprint belongs to a valid issued certificate.
+func (s *enrollService) allowed(thumbprint string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.certLocked(thumbprint)
+	return c != nil && !c.Revoked && time.Now().Before(c.NotAfter)
+}
+
+// certLocked returns the record of thumbprint; callers hold s.mu.
+func (s *enrollService) certLocked(thumbprint string) *issuedCert {
+	for _, c := range s.state.Certs {
+		if c.Thumbprint == thumbprint {
+			return c
+		}
+	}
+	return nil
+}
+
+func (s *enrollService) revoked(thumbprint string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.state.Certs {
+		if c.Thumbprint == thumbprint {
+			return c.Revoked
+		}
+	}
+	return false
+}
+
+// track keeps conn so that revoking its certificate closes it; the
+// returned func forgets it again.
+func (s *enrollService) track(thumbprint string, conn net.Conn) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[thumbprint] == nil {
+		s.sessions[thumbprint] = make(map[net.Conn]bool)
+	}
+	s.sessions[thumbprint][conn] = true
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.sessions[thumbprint], conn)
+		if len(s.sessions[thumbprint]) == 0 {
+			delete(s.sessions, thumbprint)
+		}
+	}
+}
+
+// readCSR reads and checks the PEM certificate request in body.
+func readCSR(body io.Reader) (*x509.CertificateRequest, error) {
+	data, err := io.ReadAll(io.LimitReader(body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("expected a PEM certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate request: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request signature: %v", err)
+	}
+	return csr, nil
+}
+
+// issueLocked signs csr for name, ignoring the name the client asked for,
+// and records the certificate. Callers hold s.mu, so that what allowed the
+// request (a token) changes with the record.
+func (s *enrollService) issueLocked(csr *x509.CertificateRequest, name string, assigned bool) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+	notAfter := time.Now().Add(s.validity)
+	if notAfter.After(s.ca.Leaf.NotAfter) {
+		notAfter = s.ca.Leaf.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-5 * time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.ca.Leaf, csr.PublicKey, s.ca.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign certificate: %v", err)
+	}
+
+	s.state.Certs = append(s.state.Certs, &issuedCert{
+		Thumbprint: certThumbprint(der),
+		Serial:     serial.Text(16),
+		Name:       name,
+		Assigned:   assigned,
+		NotAfter:   notAfter,
+	})
+	if err := s.save(); err != nil {
+		s.state.Certs = s.state.Certs[:len(s.state.Certs)-1]
+		return nil, fmt.Errorf("failed to record certificate: %v", err)
+	}
+	log.Printf("Issued certificate %s for %s, valid until %s", certThumbprint(der), name, notAfter.Format(time.RFC3339))
+
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.ca.Leaf.Raw})...), nil
+}
+
+func writePEMChain(w http.ResponseWriter, chain []byte) {
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(chain)
+}
+
+// handleEnroll issues a first certificate against a bootstrap token sent
+// as "Authorization: Bearer <token>".
+func (s *enrollService) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		http.Error(w, "bootstrap token required", http.StatusUnauthorized)
+		return
+	}
+
+	// A malformed upload must not cost the token
+	csr, err := readCSR(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash := hashToken(token)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found *enrollToken
+	for _, t := range s.state.Tokens {
+		if t.Hash == hash {
+			found = t
+		}
+	}
+	if found == nil || found.Used || time.Now().After(found.Expires) {
+		log.Printf("Rejected enrollment from %s: invalid or used token", r.RemoteAddr)
+		http.Error(w, "invalid or used bootstrap token", http.StatusForbidden)
+		return
+	}
+	// Spent and saved together with the certificate, under the same lock, so
+	// that it cannot be used twice
+	found.Used = true
+	name, assigned := found.Name, true
+	if name == "" {
+		// Tokens from before names were required; the client must not pick
+		// a name that revoking another client would match
+		name, assigned = "token-"+found.Hash[:12], false
+	}
+	chain, err := s.issueLocked(csr, name, assigned)
+	if err != nil {
+		found.Used = false
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writePEMChain(w, chain)
+}
+
+// handleRenew issues a new certificate to a client presenting a valid one.
+func (s *enrollService) handleRenew(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		http.Error(w, "client certificate required", http.StatusUnauthorized)
+		return
+	}
+	thumbprint := certThumbprint(r.TLS.PeerCertificates[0].Raw)
+	if !s.allowed(thumbprint) {
+		log.Printf("Rejected renewal for %s: certificate revoked or unknown", thumbprint)
+		http.Error(w, "certificate revoked or unknown", http.StatusForbidden)
+		return
+	}
+
+	csr, err := readCSR(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The renewal keeps the name of the certificate it replaces
+	s.mu.Lock()
+	var chain []byte
+	if c := s.certLocked(thumbprint); c != nil {
+		chain, err = s.issueLocked(csr, c.Name, c.Assigned)
+	} else {
+		err = fmt.Errorf("certificate %s is no longer recorded", thumbprint)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writePEMChain(w, chain)
+}
+
+// handleTokens lists tokens (GET) or creates one (POST ?name=&ttl=). The
+// name is required and becomes the name of the certificate; the token
+// itself is only shown once.
+func (s *enrollService) handleTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		writeJSON(w, s.state.Tokens)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "GET or POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name required", http.StatusBadRequest)
+		return
+	}
+	ttl := 24 * time.Hour
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		var err error
+		if ttl, err = time.ParseDuration(v); err != nil || ttl <= 0 {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+	}
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(secret)
+	entry := &enrollToken{Hash: hashToken(token), Name: name, Expires: time.Now().Add(ttl)}
+
+	s.mu.Lock()
+	s.state.Tokens = append(s.state.Tokens, entry)
+	err := s.save()
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]any{"token": token, "name": entry.Name, "expires": entry.Expires})
+}
+
+func (s *enrollService) handleCerts(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, s.state.Certs)
+}
+
+// handleRevoke revokes a certificate (POST ?thumbprint=) or every
+// certificate issued under a token's name (POST ?name=), renewals
+// included, and closes the sessions using them.
+func (s *enrollService) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	thumbprint := strings.ToUpper(r.URL.Query().Get("thumbprint"))
+	name := r.URL.Query().Get("name")
+	if thumbprint == "" && name == "" {
+		http.Error(w, "thumbprint or name required", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	var revoked []*issuedCert
+	for _, c := range s.state.Certs {
+		if (thumbprint != "" && c.Thumbprint == thumbprint) || (name != "" && c.Assigned && c.Name == name) {
+			if !c.Revoked {
+				c.Revoked, c.RevokedAt = true, time.Now()
+			}
+			for conn := range s.sessions[c.Thumbprint] {
+				conn.Close()
+			}
+			revoked = append(revoked, c)
+		}
+	}
+	if len(revoked) == 0 {
+		s.mu.Unlock()
+		http.Error(w, "unknown certificate", http.StatusNotFound)
+		return
+	}
+	err := s.save()
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, c := range revoked {
+		log.Printf("Revoked certificate %s (%s)", c.Thumbprint, c.Name)
+	}
+	writeJSON(w, revoked)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testEnrollService returns a service with a throwaway CA.
+func testEnrollService(t *testing.T) *enrollService {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caLeaf, _ := x509.ParseCertificate(caDER)
+	return &enrollService{
+		ca:       tls.Certificate{Certificate: [][]byte{caDER}, PrivateKey: caKey, Leaf: caLeaf},
+		validity: time.Hour,
+		path:     filepath.Join(t.TempDir(), "enroll.json"),
+		sessions: make(map[string]map[net.Conn]bool),
+	}
+}
+
+// testCSR returns a PEM certificate request asking for name.
+func testCSR(t *testing.T, name string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: name}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+}
+
+func enroll(s *enrollService, token string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/enroll", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	s.handleEnroll(rec, req)
+	return rec
+}
+
+// issuedName returns the common name of the certificate in an answer.
+func issuedName(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("enrollment: %d %s", rec.Code, rec.Body)
+	}
+	block, _ := pem.Decode(rec.Body.Bytes())
+	if block == nil {
+		t.Fatal("no certificate returned")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Subject.CommonName
+}
+
+// TestEnrollKeepsTokenOnBadCSR checks that a malformed certificate request
+// leaves the bootstrap token usable, and that a good one spends it.
+func TestEnrollKeepsTokenOnBadCSR(t *testing.T) {
+	s := testEnrollService(t)
+	s.state.Tokens = []*enrollToken{{Hash: hashToken("secret"), Name: "router1", Expires: time.Now().Add(time.Hour)}}
+	csrPEM := testCSR(t, "router1")
+
+	for _, bad := range [][]byte{csrPEM[:len(csrPEM)/2], []byte("not a request")} {
+		if rec := enroll(s, "secret", bad); rec.Code != http.StatusBadRequest {
+			t.Fatalf("malformed request: %d %s", rec.Code, rec.Body)
+		}
+		if s.state.Tokens[0].Used {
+			t.Fatal("malformed request spent the token")
+		}
+	}
+
+	if name := issuedName(t, enroll(s, "secret", csrPEM)); name != "router1" {
+		t.Fatalf("certificate issued for %q, want router1", name)
+	}
+	if !s.state.Tokens[0].Used || len(s.state.Certs) != 1 {
+		t.Fatalf("token used %v, %d certificates recorded", s.state.Tokens[0].Used, len(s.state.Certs))
+	}
+
+	if rec := enroll(s, "secret", csrPEM); rec.Code != http.StatusForbidden {
+		t.Fatalf("second enrollment with the token: %d %s", rec.Code, rec.Body)
+	}
+}
+
+// TestEnrollNames checks that certificates get the token's name rather than
+// the one in the CSR, so that revoking by name cannot hit a client that
+// picked another client's name.
+func TestEnrollNames(t *testing.T) {
+	s := testEnrollService(t)
+
+	rec := httptest.NewRecorder()
+	s.handleTokens(rec, httptest.NewRequest(http.MethodPost, "/enroll/tokens?ttl=1h", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("token without a name: %d %s", rec.Code, rec.Body)
+	}
+
+	s.state.Tokens = []*enrollToken{
+		{Hash: hashToken("victim"), Name: "router1", Expires: time.Now().Add(time.Hour)},
+		{Hash: hashToken("attacker"), Name: "router2", Expires: time.Now().Add(time.Hour)},
+		{Hash: hashToken("legacy"), Expires: time.Now().Add(time.Hour)},
+	}
+	if name := issuedName(t, enroll(s, "victim", testCSR(t, "router1"))); name != "router1" {
+		t.Fatalf("certificate issued for %q, want router1", name)
+	}
+	if name := issuedName(t, enroll(s, "attacker", testCSR(t, "router1"))); name != "router2" {
+		t.Fatalf("CSR chose the name %q, want the token's router2", name)
+	}
+	legacy := issuedName(t, enroll(s, "legacy", testCSR(t, "router1")))
+	if want := "token-" + hashToken("legacy")[:12]; legacy != want {
+		t.Fatalf("token without a name issued %q, want %q", legacy, want)
+	}
+	// A record from before names were assigned
+	s.state.Certs = append(s.state.Certs, &issuedCert{Thumbprint: "OLD", Name: "router1", NotAfter: time.Now().Add(time.Hour)})
+
+	rec = httptest.NewRecorder()
+	s.handleRevoke(rec, httptest.NewRequest(http.MethodPost, "/enroll/revoke?name=router1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("revoke: %d %s", rec.Code, rec.Body)
+	}
+	for _, c := range s.state.Certs {
+		if want := c.Name == "router1" && c.Assigned; c.Revoked != want {
+			t.Errorf("certificate %s named %q (assigned %v): revoked %v, want %v", c.Thumbprint, c.Name, c.Assigned, c.Revoked, want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// handleMux serves a multiplexed session: public connections on the ports
+// of its remote forwards become streams to the client, and streams the
+// client opens for its local forwards are dialed like a Connect hello.
+func handleMux(conn net.Conn, clientIP net.IP, thumbprint string, hello *tunnelHello) {
+	reply := &tunnelReply{Compression: negotiateCompression(hello.Compression)}
+	var expiresAt time.Time
+	if hello.TotalMinutes != nil {
+		expiresAt = hello.StartedTime.Add(time.Duration(*hello.TotalMinutes) * time.Minute)
+		if !time.Now().Before(expiresAt) {
+			reply.Error = "tunnel expired at " + expiresAt.Format(time.RFC3339)
+		}
+	}
+	if len(hello.Remote) > 0 && relayPorts == nil && reply.Error == "" {
+		reply.Error, reply.Code = "remote forwards need a relay with -port-range", "refused"
+	}
+
+	var routes []*portRoute
+	defer func() {
+		for _, route := range routes {
+			relayPorts.release(route)
+		}
+	}()
+	for i, requested := range hello.Remote {
+		if reply.Error != "" {
+			break
+		}
+		route, err := relayPorts.acquire(portKey(thumbprint, i), requested)
+		if err != nil {
+			reply.Error, reply.Code = err.Error(), "refused"
+			break
+		}
+		routes = append(routes, route)
+		reply.Ports = append(reply.Ports, route.port)
+	}
+	if reply.Error != "" {
+		reply.Ports = nil
+	}
+
+	if err := writeReply(conn, clientIP, 0, reply); err != nil {
+		log.Printf("Failed to send response to %s: %v", clientIP, err)
+		return
+	}
+	if reply.Error != "" {
+		log.Printf("Refused client %s: %s", clientIP, reply.Error)
+		return
+	}
+
+	if reply.Compression != "" {
+		conn = newCompressedConn(conn)
+	}
+	self := &peerEndpoint{thumbprint: thumbprint}
+	if len(hello.P2P) > 0 {
+		self.candidates = peerCandidates(conn.RemoteAddr(), hello.P2P)
+	}
+	session := newMuxSession(conn, false, func(st *muxStream, payload []byte) {
+		serveMuxConnect(st, payload, clientIP, self)
+	})
+	defer session.Close()
+	if !expiresAt.IsZero() {
+		timer := time.AfterFunc(time.Until(expiresAt), func() {
+			log.Printf("Tunnel for %s expired, closing it", clientIP)
+			session.Close()
+		})
+		defer timer.Stop()
+	}
+	for i, route := range routes {
+		go forwardPublic(session, route, i)
+		if len(self.candidates) > 0 {
+			defer registerPeer(route.port, &peerEndpoint{session: session, thumbprint: thumbprint, candidates: self.candidates, forward: i})()
+		}
+	}
+
+	log.Printf("Multiplexed session from %s (public ports %v)", clientIP, reply.Ports)
+	<-session.done
+	log.Printf("Multiplexed session from %s ended: %v", clientIP, session.Err())
+}
+
+// forwardPublic hands the connections of a remote forward's port to the
+// client as new streams.
+func forwardPublic(session *muxSession, route *portRoute, forward int) {
+	for {
+		select {
+		case publicConn := <-route.sessions:
+			go func() {
+				req, _ := json.Marshal(&muxRequest{Forward: forward, Remote: publicConn.RemoteAddr().String()})
+				st, err := session.open(req)
+				if errors.Is(err, errMuxClosed) {
+					// Another session of the client may take it
+					offerPublic(publicConn, route.sessions)
+					return
+				}
+				if err != nil {
+					log.Printf("Public connection from %s on port %d refused by client: %v", publicConn.RemoteAddr(), route.port, err)
+					publicConn.Close()
+					return
+				}
+				defer publicConn.Close()
+				defer st.Close()
+				log.Printf("Public connection from %s on port %d forwarded as stream %d", publicConn.RemoteAddr(), route.port, st.id)
+				relayTraffic(st, publicConn)
+			}()
+		case <-session.done:
+			return
+		}
+	}
+}
+
+func serveMuxConnect(st *muxStream, payload []byte, clientIP net.IP, self *peerEndpoint) {
+	var req muxRequest
+	if err := json.Unmarshal(payload, &req); err != nil || (req.Connect == "" && req.Rendezvous == "") {
+		st.reject("invalid stream request")
+		return
+	}
+	if req.Rendezvous != "" {
+		serveRendezvous(st, req.Rendezvous, self)
+		return
+	}
+	target, reply := dialDestination(req.Connect)
+	if target == nil {
+		log.Printf("Connect from %s to %s failed: %s", clientIP, req.Connect, reply.Error)
+		st.reject(reply.Error)
+		return
+	}
+	defer target.Close()
+	defer st.Close()
+	if err := st.accept(); err != nil {
+		return
+	}
+
+	log.Printf("Client %s connected to %s (stream %d)", clientIP, req.Connect, st.id)
+	relayTraffic(st, target)
+}
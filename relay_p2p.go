@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// peerEndpoint is a multiplexed session that accepts direct connections
+// from other clients.
+type peerEndpoint struct {
+	session    *muxSession
+	thumbprint string
+	candidates []string
+	forward    int
+}
+
+var (
+	peersMu sync.Mutex
+	// peers maps the public ports of remote forwards to their sessions.
+	peers = make(map[int]*peerEndpoint)
+)
+
+// peerCandidates puts the address the relay observes first, followed by
+// the ones the client reported.
+func peerCandidates(observed net.Addr, reported []string) []string {
+	candidates := []string{observed.String()}
+	for _, c := range reported {
+		if c != candidates[0] {
+			candidates = append(candidates, c)
+		}
+	}
+	return candidates
+}
+
+func registerPeer(port int, endpoint *peerEndpoint) func() {
+	peersMu.Lock()
+	peers[port] = endpoint
+	peersMu.Unlock()
+	return func() {
+		peersMu.Lock()
+		if peers[port] == endpoint {
+			delete(peers, port)
+		}
+		peersMu.Unlock()
+	}
+}
+
+// findPeer returns the session behind dest when dest is a public port of
+// this relay.
+func findPeer(dest string) *peerEndpoint {
+	host, portStr, err := net.SplitHostPort(dest)
+	port, _ := strconv.Atoi(portStr)
+	if err != nil {
+		return nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 || !isLocalIP(ips[0]) {
+		return nil
+	}
+	peersMu.Lock()
+	defer peersMu.Unlock()
+	return peers[port]
+}
+
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if prefix, ok := addr.(*net.IPNet); ok && prefix.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveRendezvous introduces the client that opened st to the client
+// serving dest. The streams are only used for the introduction; the
+// clients fall back to the relay path when they cannot reach each other.
+func serveRendezvous(st *muxStream, dest string, self *peerEndpoint) {
+	if len(self.candidates) == 0 {
+		st.reject("direct connections are not enabled for this session")
+		return
+	}
+	peer := findPeer(dest)
+	if peer == nil {
+		st.reject("no direct path to " + dest)
+		return
+	}
+
+	token := make([]byte, 16)
+	rand.Read(token)
+	offer := peerOffer{Token: hex.EncodeToString(token), Thumbprint: self.thumbprint, Candidates: self.candidates, Forward: peer.forward}
+	req, _ := json.Marshal(&muxRequest{Peer: &offer})
+	peerStream, err := peer.session.open(req)
+	if err != nil {
+		st.reject(fmt.Sprintf("peer declined: %v", err))
+		return
+	}
+	peerStream.Close()
+
+	defer st.Close()
+	if err := st.accept(); err != nil {
+		return
+	}
+	offer.Thumbprint, offer.Candidates, offer.Dial = peer.thumbprint, peer.candidates, true
+	if err := writeJSONFrame(st, &offer); err != nil {
+		return
+	}
+	st.CloseWrite()
+	log.Printf("Rendezvous for %s between %s and %s", dest, self.candidates[0], peer.candidates[0])
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// portLinger keeps a client's public port open between sessions, so that
+// clients reconnecting after each stream do not drop connections.
+const portLinger = time.Minute
+
+// portRoute is the public listener of one client; its sessions take turns
+// receiving the connections.
+type portRoute struct {
+	port     int
+	key      string
+	listener net.Listener
+	sessions chan net.Conn
+	refs     int
+	linger   *time.Timer
+}
+
+// portAllocator hands out public ports from a range. Each client
+// certificate keeps its port across reconnects and relay restarts. The
+// reservations are keyed by thumbprint, with "#n" appended for the further
+// remote forwards of a multiplexed session.
+type portAllocator struct {
+	low, high int
+	path      string
+
+	mu       sync.Mutex
+	reserved map[string]int
+	routes   map[int]*portRoute
+}
+
+var relayPorts *portAllocator
+
+func newPortAllocator(spec, path string) (*portAllocator, error) {
+	lowText, highText, _ := strings.Cut(spec, "-")
+	low, err1 := strconv.Atoi(strings.TrimSpace(lowText))
+	high, err2 := strconv.Atoi(strings.TrimSpace(highText))
+	if err1 != nil || err2 != nil || low <= 0 || high > 65535 || low > high {
+		return nil, fmt.Errorf("invalid -port-range %q, expected e.g. 20000-20999", spec)
+	}
+
+	a := &portAllocator{low: low, high: high, path: path, reserved: make(map[string]int), routes: make(map[int]*portRoute)}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &a.reserved); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	adminMux.HandleFunc("/ports", a.handlePorts)
+	adminMux.HandleFunc("/ports/release", a.handleRelease)
+	return a, nil
+}
+
+// save writes the reservations; callers hold a.mu.
+func (a *portAllocator) save() {
+	data, err := json.MarshalIndent(a.reserved, "", "  ")
+	if err == nil {
+		tmp := a.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, a.path)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to save port reservations: %v", err)
+	}
+}
+
+func portKey(thumbprint string, forward int) string {
+	if forward == 0 {
+		return thumbprint
+	}
+	return fmt.Sprintf("%s#%d", thumbprint, forward)
+}
+
+func portOwner(key string) string {
+	owner, _, _ := strings.Cut(key, "#")
+	return owner
+}
+
+func (a *portAllocator) reservedBy(port int) string {
+	for key, p := range a.reserved {
+		if p == port {
+			return key
+		}
+	}
+	return ""
+}
+
+// acquire returns the public port for key: the requested one if it is in
+// range and not reserved by another client, else its reservation, else a
+// free port from the range.
+func (a *portAllocator) acquire(key string, requested int) (*portRoute, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	owner := portOwner(key)
+	port := a.reserved[key]
+	if requested != 0 {
+		if requested < a.low || requested > a.high {
+			return nil, fmt.Errorf("port %d is outside the relay's range %d-%d", requested, a.low, a.high)
+		}
+		if other := a.reservedBy(requested); other != "" && portOwner(other) != owner {
+			return nil, fmt.Errorf("port %d is reserved by another client", requested)
+		}
+		port = requested
+	}
+
+	if route, ok := a.routes[port]; ok && port != 0 {
+		if portOwner(route.key) != owner {
+			return nil, fmt.Errorf("port %d is in use by another client", port)
+		}
+		if route.key != key {
+			return nil, fmt.Errorf("port %d is already forwarded", port)
+		}
+		if route.linger != nil {
+			route.linger.Stop()
+			route.linger = nil
+		}
+		route.refs++
+		return route, nil
+	}
+
+	var listener net.Listener
+	var err error
+	if port != 0 {
+		if listener, err = net.Listen("tcp", fmt.Sprintf(":%d", port)); err != nil {
+			return nil, fmt.Errorf("port %d is not available: %v", port, err)
+		}
+	} else {
+		for p := a.low; p <= a.high && listener == nil; p++ {
+			if _, busy := a.routes[p]; busy || a.reservedBy(p) != "" {
+				continue
+			}
+			if listener, err = net.Listen("tcp", fmt.Sprintf(":%d", p)); err == nil {
+				port = p
+			}
+		}
+		if listener == nil {
+			return nil, fmt.Errorf("no free port left in %d-%d", a.low, a.high)
+		}
+	}
+
+	if a.reserved[key] != port {
+		// A client moving a port between its forwards keeps one reservation
+		if other := a.reservedBy(port); other != "" {
+			delete(a.reserved, other)
+		}
+		a.reserved[key] = port
+		a.save()
+		log.Printf("Public port %d reserved for %s", port, key)
+	}
+	route := &portRoute{port: port, key: key, listener: listener, sessions: make(chan net.Conn), refs: 1}
+	a.routes[port] = route
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("Error accepting public connection on port %d: %v", port, err)
+				}
+				return
+			}
+			go offerPublic(conn, route.sessions)
+		}
+	}()
+	return route, nil
+}
+
+// release drops a session; the port closes once no session has used it
+// for portLinger.
+func (a *portAllocator) release(route *portRoute) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if route.refs--; route.refs > 0 {
+		return
+	}
+	route.linger = time.AfterFunc(portLinger, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if route.refs == 0 && a.routes[route.port] == route {
+			route.listener.Close()
+			delete(a.routes, route.port)
+		}
+	})
+}
+
+func (a *portAllocator) handlePorts(w http.ResponseWriter, r *http.Request) {
+	type portInfo struct {
+		Thumbprint string
+		Forward    int `json:",omitempty"`
+		Port       int
+		Open       bool
+		Sessions   int
+	}
+
+	a.mu.Lock()
+	list := make([]portInfo, 0, len(a.reserved))
+	for key, port := range a.reserved {
+		info := portInfo{Thumbprint: portOwner(key), Port: port}
+		if _, forward, ok := strings.Cut(key, "#"); ok {
+			info.Forward, _ = strconv.Atoi(forward)
+		}
+		if route, ok := a.routes[port]; ok && route.key == key {
+			info.Open, info.Sessions = true, route.refs
+		}
+		list = append(list, info)
+	}
+	a.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Port < list[j].Port })
+	writeJSON(w, list)
+}
+
+// handleRelease drops the reservations of a client (POST ?thumbprint=); an
+// open listener stays until its sessions are gone.
+func (a *portAllocator) handleRelease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	owner := strings.ToUpper(r.URL.Query().Get("thumbprint"))
+
+	var ports []int
+	a.mu.Lock()
+	for key, port := range a.reserved {
+		if portOwner(key) == owner {
+			delete(a.reserved, key)
+			ports = append(ports, port)
+		}
+	}
+	if len(ports) > 0 {
+		a.save()
+	}
+	a.mu.Unlock()
+	if len(ports) == 0 {
+		http.Error(w, "no reservation for this thumbprint", http.StatusNotFound)
+		return
+	}
+	sort.Ints(ports)
+	log.Printf("Public ports %v released from %s", ports, owner)
+	writeJSON(w, map[string]any{"thumbprint": owner, "ports": ports})
+}
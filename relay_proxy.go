@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const maxHistoryPerToken = 1000
+
+// proxyIpHistory mirrors Models/ProxyIpHistory.
+type proxyIpHistory struct {
+	UserToken string
+	IP        string
+	Date      time.Time
+	IsHealth  bool
+}
+
+type egressSession struct {
+	conn     net.Conn
+	done     chan struct{}
+	compress bool
+
+	// taken is set by whoever ends the wait: the proxy service claiming
+	// the session, or its watcher when the client went away.
+	taken   atomic.Bool
+	watched chan error
+}
+
+type egressClient struct {
+	id       string
+	ip       string
+	sessions chan *egressSession
+}
+
+type proxySession struct {
+	id       string
+	token    string
+	egressID string
+	assigned time.Time
+}
+
+type proxyService struct {
+	mu       sync.Mutex
+	tokens   map[string]string
+	clients  map[string]*egressClient
+	order    []string
+	next     int
+	sessions map[string]*proxySession
+	history  map[string][]proxyIpHistory
+	rotate   time.Duration
+}
+
+var proxySvc = &proxyService{
+	clients:  make(map[string]*egressClient),
+	sessions: make(map[string]*proxySession),
+	history:  make(map[string][]proxyIpHistory),
+}
+
+// registerEgress parks an egress session until the proxy service uses it.
+// It blocks so that the caller keeps ownership of conn.
+func registerEgress(conn net.Conn, clientIP net.IP, thumbprint string, hello *tunnelHello) {
+	id := thumbprint + "@" + clientIP.String()
+	s := proxySvc
+
+	s.mu.Lock()
+	client, ok := s.clients[id]
+	if !ok {
+		client = &egressClient{id: id, ip: clientIP.String(), sessions: make(chan *egressSession, 64)}
+		s.clients[id] = client
+		s.order = append(s.order, id)
+		log.Printf("Egress client %s registered", id)
+	}
+	s.mu.Unlock()
+
+	reply := &tunnelReply{Compression: negotiateCompression(hello.Compression)}
+	if err := writeReply(conn, clientIP, 0, reply); err != nil {
+		log.Printf("Failed to send response to %s: %v", clientIP, err)
+		return
+	}
+
+	session := &egressSession{conn: conn, done: make(chan struct{}), compress: reply.Compression != "", watched: make(chan error, 1)}
+	select {
+	case client.sessions <- session:
+	default:
+		log.Printf("Egress client %s has too many idle sessions", id)
+		return
+	}
+
+	// The client says nothing until it gets a command, so a read that ends
+	// means it went away; clients reconnect idle sessions regularly.
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		if session.taken.CompareAndSwap(false, true) {
+			client.dropDead()
+			close(session.done)
+			return
+		}
+		session.watched <- err
+	}()
+	<-session.done
+}
+
+// claim takes a parked session for a proxy user. It stops the watcher and
+// reports false when the client is gone.
+func (e *egressSession) claim() bool {
+	if !e.taken.CompareAndSwap(false, true) {
+		return false
+	}
+	// Read timeouts leave the TLS conn usable
+	e.conn.SetReadDeadline(time.Unix(1, 0))
+	err := <-e.watched
+	e.conn.SetReadDeadline(time.Time{})
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	close(e.done)
+	return false
+}
+
+// take returns an idle session that is still connected, or nil when none
+// comes within timeout.
+func (c *egressClient) take(timeout time.Duration) *egressSession {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case session := <-c.sessions:
+			if session.claim() {
+				return session
+			}
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+// dropDead removes the sessions whose client went away from the queue, so
+// that they do not take the places of new ones.
+func (c *egressClient) dropDead() {
+	for n := len(c.sessions); n > 0; n-- {
+		var session *egressSession
+		select {
+		case session = <-c.sessions:
+		default:
+			return
+		}
+		if session.taken.Load() {
+			continue
+		}
+		select {
+		case c.sessions <- session:
+		default:
+			// Filled up by new sessions meanwhile
+			if session.taken.CompareAndSwap(false, true) {
+				close(session.done)
+			}
+		}
+	}
+}
+
+func (s *proxyService) removeClient(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.clients, id)
+	for i, o := range s.order {
+		if o == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	log.Printf("Egress client %s removed", id)
+}
+
+// pickEgress returns the next egress client in round-robin order, avoiding
+// exclude when another client is available. Callers hold s.mu.
+func (s *proxyService) pickEgress(exclude string) *egressClient {
+	var fallback *egressClient
+	for i := 0; i < len(s.order); i++ {
+		client := s.clients[s.order[(s.next+i)%len(s.order)]]
+		if client.id == exclude {
+			fallback = client
+			continue
+		}
+		s.next = (s.next + i + 1) % len(s.order)
+		return client
+	}
+	return fallback
+}
+
+func (s *proxyService) recordHistory(token, ip string, healthy bool) {
+	entries := append(s.history[token], proxyIpHistory{UserToken: token, IP: ip, Date: time.Now().UTC(), IsHealth: healthy})
+	if len(entries) > maxHistoryPerToken {
+		entries = entries[len(entries)-maxHistoryPerToken:]
+	}
+	s.history[token] = entries
+}
+
+// assign returns the sticky egress client for a session, assigning a new
+// one when there is none yet, when it has expired or when rotate is set.
+func (s *proxyService) assign(sessionID, token string, rotate bool) (*egressClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[sessionID]
+	if ok && !rotate && s.rotate > 0 && time.Since(session.assigned) > s.rotate {
+		rotate = true
+	}
+	if ok && !rotate {
+		if client, ok := s.clients[session.egressID]; ok {
+			return client, nil
+		}
+	}
+
+	exclude := ""
+	if ok {
+		exclude = session.egressID
+	}
+	client := s.pickEgress(exclude)
+	if client == nil {
+		return nil, fmt.Errorf("no egress clients connected")
+	}
+
+	if !ok {
+		session = &proxySession{id: sessionID, token: token}
+		s.sessions[sessionID] = session
+	}
+	if session.egressID != client.id {
+		log.Printf("Proxy session %s now exits via %s", sessionID, client.ip)
+	}
+	session.egressID = client.id
+	session.assigned = time.Now()
+	s.recordHistory(token, client.ip, true)
+	return client, nil
+}
+
+func (s *proxyService) dial(sessionID, token, dest string) (net.Conn, *egressSession, *tunnelReply) {
+	host, portStr, err := net.SplitHostPort(dest)
+	port, _ := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, nil, &tunnelReply{Error: "invalid destination " + dest, Code: "failed"}
+	}
+
+	rotate := false
+	for attempt := 0; attempt < 3; attempt++ {
+		client, err := s.assign(sessionID, token, rotate)
+		if err != nil {
+			return nil, nil, &tunnelReply{Error: err.Error(), Code: "unreachable"}
+		}
+		rotate = true
+
+		session := client.take(5 * time.Second)
+		if session == nil {
+			log.Printf("Egress client %s has no idle sessions", client.id)
+			s.mu.Lock()
+			s.recordHistory(token, client.ip, false)
+			s.mu.Unlock()
+			s.removeClient(client.id)
+			continue
+		}
+
+		cmd := &egressCommand{SessionId: sessionID, Host: host, Port: port, Ip: client.ip, Command: egressConnect}
+		session.conn.SetDeadline(time.Now().Add(15 * time.Second))
+		reply := &tunnelReply{}
+		err = writeJSONFrame(session.conn, cmd)
+		if err == nil {
+			err = readJSONFrame(session.conn, reply)
+		}
+		if err != nil {
+			// Stale session, the client replenishes them so try again
+			close(session.done)
+			rotate = false
+			continue
+		}
+		session.conn.SetDeadline(time.Time{})
+
+		if reply.Error != "" {
+			close(session.done)
+			return nil, nil, reply
+		}
+		// Compression starts after the command exchange
+		if session.compress {
+			return newCompressedConn(session.conn), session, reply
+		}
+		return session.conn, session, reply
+	}
+	return nil, nil, &tunnelReply{Error: "no working egress client", Code: "unreachable"}
+}
+
+func (s *proxyService) authenticate(user, pass string) (string, string, bool) {
+	token, sessionID := user, user
+	if i := strings.Index(user, "-session-"); i >= 0 {
+		token = user[:i]
+	}
+	secret, ok := s.tokens[token]
+	return token, sessionID, ok && secret == pass
+}
+
+func startProxyService(addr, tokenList string, rotate time.Duration) error {
+	s := proxySvc
+	s.rotate = rotate
+	s.tokens = make(map[string]string)
+	for _, entry := range strings.Split(tokenList, ",") {
+		name, secret, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || name == "" {
+			continue
+		}
+		s.tokens[name] = secret
+	}
+	if len(s.tokens) == 0 {
+		return fmt.Errorf("the proxy service needs at least one -proxy-token name:secret")
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	log.Printf("Proxy service listening on %s", addr)
+
+	adminMux.HandleFunc("/proxy/rotate", s.handleRotate)
+	adminMux.HandleFunc("/proxy/sessions", s.handleSessions)
+	adminMux.HandleFunc("/proxy/history", s.handleHistory)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("Error accepting proxy connection: %v", err)
+				continue
+			}
+			go s.handleConn(conn)
+		}
+	}()
+	return nil
+}
+
+func (s *proxyService) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	if first, err := reader.Peek(1); err == nil && first[0] == socks5Version {
+		var token, sessionID string
+		dest, _, err := readSOCKS5Request(conn, reader, func(user, pass string) bool {
+			var ok bool
+			token, sessionID, ok = s.authenticate(user, pass)
+			return ok
+		})
+		if err != nil {
+			log.Printf("SOCKS5 request from %s rejected: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		stream, session, reply := s.dial(sessionID, token, dest)
+		if stream == nil {
+			log.Printf("Proxy session %s to %s failed: %s", sessionID, dest, reply.Error)
+			writeSOCKS5Reply(conn, socks5ReplyCode(reply.Code))
+			return
+		}
+		defer close(session.done)
+
+		writeSOCKS5Reply(conn, socks5Succeeded)
+		proxyStreams(conn, reader, stream)
+		return
+	}
+
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+	token, sessionID, ok := s.authenticate(parseProxyAuthorization(req))
+	if !ok {
+		writeProxyAuthRequired(conn)
+		return
+	}
+
+	dest := req.Host
+	if req.Method != http.MethodConnect && req.URL.Port() == "" {
+		dest = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	stream, session, reply := s.dial(sessionID, token, dest)
+	if stream == nil {
+		log.Printf("Proxy session %s to %s failed: %s", sessionID, dest, reply.Error)
+		fmt.Fprintf(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return
+	}
+	defer close(session.done)
+
+	if req.Method == http.MethodConnect {
+		fmt.Fprintf(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	} else {
+		// One request per connection keeps the exit stable per request
+		req.Header.Del("Proxy-Authorization")
+		req.Header.Del("Proxy-Connection")
+		req.Close = true
+		if err := req.Write(stream); err != nil {
+			return
+		}
+	}
+	proxyStreams(conn, reader, stream)
+}
+
+func (s *proxyService) handleRotate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := r.URL.Query().Get("session")
+
+	s.mu.Lock()
+	session, ok := s.sessions[sessionID]
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	client, err := s.assign(sessionID, session.token, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, map[string]string{"session": sessionID, "ip": client.ip})
+}
+
+func (s *proxyService) handleSessions(w http.ResponseWriter, r *http.Request) {
+	type sessionInfo struct {
+		SessionId string
+		UserToken string
+		IP        string
+		Assigned  time.Time
+	}
+
+	s.mu.Lock()
+	var list []sessionInfo
+	for _, session := range s.sessions {
+		info := sessionInfo{SessionId: session.id, UserToken: session.token, Assigned: session.assigned}
+		if client, ok := s.clients[session.egressID]; ok {
+			info.IP = client.ip
+		}
+		list = append(list, info)
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, list)
+}
+
+func (s *proxyService) handleHistory(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	s.mu.Lock()
+	var entries []proxyIpHistory
+	if token != "" {
+		entries = append(entries, s.history[token]...)
+	} else {
+		for _, h := range s.history {
+			entries = append(entries, h...)
+		}
+	}
+	s.mu.Unlock()
+
+	if r.URL.Query().Get("format") != "csv" {
+		writeJSON(w, entries)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=proxy_ip_history.csv")
+	out := csv.NewWriter(w)
+	out.Write([]string{"UserToken", "IP", "Date", "IsHealth"})
+	for _, e := range entries {
+		out.Write([]string{e.UserToken, e.IP, e.Date.Format(time.RFC3339), strconv.FormatBool(e.IsHealth)})
+	}
+	out.Flush()
+}
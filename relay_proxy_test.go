@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestEgressDeadSessions checks that parked egress sessions whose client
+// disconnected leave the queue and are never handed to a proxy user.
+func TestEgressDeadSessions(t *testing.T) {
+	const id = "dead-sessions@127.0.0.1"
+	defer proxySvc.removeClient(id)
+
+	var clients []net.Conn
+	for i := 0; i < 3; i++ {
+		clientConn, relayConn := tcpPair(t)
+		go registerEgress(relayConn, net.ParseIP("127.0.0.1"), "dead-sessions", &tunnelHello{Egress: true})
+		if _, reply, err := readReply(clientConn); err != nil || reply.Error != "" {
+			t.Fatalf("session %d not parked: %v %v", i, err, reply)
+		}
+		clients = append(clients, clientConn)
+	}
+	proxySvc.mu.Lock()
+	client := proxySvc.clients[id]
+	proxySvc.mu.Unlock()
+
+	clients[0].Close()
+	clients[2].Close()
+	for deadline := time.Now().Add(5 * time.Second); len(client.sessions) != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions queued, want 1", len(client.sessions))
+		}
+	}
+
+	session := client.take(time.Second)
+	if session == nil {
+		t.Fatal("live session not taken")
+	}
+	defer close(session.done)
+	cmd := &egressCommand{SessionId: "s", Host: "example.com", Port: 80, Command: egressConnect}
+	if err := writeJSONFrame(session.conn, cmd); err != nil {
+		t.Fatal(err)
+	}
+	got := &egressCommand{}
+	if err := readJSONFrame(clients[1], got); err != nil || got.Host != "example.com" {
+		t.Fatalf("command on the live session: %v %+v", err, got)
+	}
+	if client.take(100*time.Millisecond) != nil {
+		t.Fatal("took a session after the only live one")
+	}
+}
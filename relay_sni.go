@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sniRoute queues the tunnel sessions of the client that registered a
+// hostname. The first client certificate to register a name owns it while
+// it has sessions. With terminate the relay completes the TLS handshake
+// itself and the sessions get plaintext.
+type sniRoute struct {
+	owner     string
+	terminate bool
+	sessions  chan net.Conn
+	refs      int
+}
+
+var (
+	sniMu     sync.Mutex
+	sniRoutes = make(map[string]*sniRoute)
+)
+
+func registerSNI(hostname, owner string, terminate bool) (*sniRoute, error) {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	sniMu.Lock()
+	defer sniMu.Unlock()
+
+	route, ok := sniRoutes[hostname]
+	if !ok {
+		route = &sniRoute{owner: owner, terminate: terminate, sessions: make(chan net.Conn)}
+		sniRoutes[hostname] = route
+		log.Printf("Hostname %s registered by %s", hostname, owner)
+	} else if route.owner != owner {
+		return nil, fmt.Errorf("hostname %s is registered by another client", hostname)
+	} else if route.terminate != terminate {
+		return nil, fmt.Errorf("hostname %s is registered with another TLS mode", hostname)
+	}
+	route.refs++
+	return route, nil
+}
+
+func releaseSNI(hostname string) {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	sniMu.Lock()
+	defer sniMu.Unlock()
+
+	if route, ok := sniRoutes[hostname]; ok {
+		if route.refs--; route.refs == 0 {
+			delete(sniRoutes, hostname)
+			log.Printf("Hostname %s released", hostname)
+		}
+	}
+}
+
+// lookupSNI finds the route for a server name, trying "*.example.com"
+// registrations after the exact name.
+func lookupSNI(serverName string) *sniRoute {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	sniMu.Lock()
+	defer sniMu.Unlock()
+
+	if route, ok := sniRoutes[name]; ok {
+		return route
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		return sniRoutes["*."+parent]
+	}
+	return nil
+}
+
+func acceptSNI(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Error accepting SNI connection: %v", err)
+			continue
+		}
+		go routeSNI(conn)
+	}
+}
+
+// routeSNI reads the ClientHello and hands the raw stream, ClientHello
+// included, to a session of the matching client. Routes that terminate TLS
+// get the decrypted stream instead.
+func routeSNI(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var peeked bytes.Buffer
+	serverName, protos, err := readServerName(io.TeeReader(conn, &peeked))
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Printf("No TLS ClientHello from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	var stream net.Conn = &readerConn{Conn: conn, r: io.MultiReader(bytes.NewReader(peeked.Bytes()), conn)}
+
+	if relayCerts != nil && slices.Contains(protos, acmeALPNProto) {
+		// TLS-ALPN-01 validation, answered by the relay itself
+		if _, err := relayCerts.terminateTLS(stream, protos); err != nil {
+			log.Printf("TLS-ALPN-01 validation for %s failed: %v", serverName, err)
+		}
+		conn.Close()
+		return
+	}
+
+	route := lookupSNI(serverName)
+	if route == nil {
+		log.Printf("No tunnel for server name %q from %s", serverName, conn.RemoteAddr())
+		// Fatal unrecognized_name alert
+		conn.Write([]byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x70})
+		conn.Close()
+		return
+	}
+
+	if route.terminate {
+		tlsConn, err := relayCerts.terminateTLS(stream, protos)
+		if err != nil {
+			log.Printf("TLS handshake for %s from %s failed: %v", serverName, conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		stream = tlsConn
+	}
+
+	select {
+	case route.sessions <- stream:
+	case <-time.After(10 * time.Second):
+		log.Printf("No tunnel session available for %s", serverName)
+		conn.Close()
+	}
+}
+
+// readServerName lets crypto/tls parse the ClientHello and stops the
+// handshake right after. It also returns the offered ALPN protocols.
+func readServerName(r io.Reader) (string, []string, error) {
+	var serverName string
+	var protos []string
+	var seen bool
+	err := tls.Server(helloConn{r: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName, protos, seen = hello.ServerName, hello.SupportedProtos, true
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !seen {
+		return "", nil, err
+	}
+	return serverName, protos, nil
+}
+
+var errHelloRead = fmt.Errorf("client hello read")
+
+// helloConn feeds a handshake from a reader and refuses to write, so that
+// nothing is sent to the real client.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error)       { return c.r.Read(p) }
+func (c helloConn) Write(p []byte) (int, error)      { return 0, io.ErrClosedPipe }
+func (c helloConn) Close() error                     { return nil }
+func (c helloConn) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (c helloConn) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+func (c helloConn) SetDeadline(time.Time) error      { return nil }
+func (c helloConn) SetReadDeadline(time.Time) error  { return nil }
+func (c helloConn) SetWriteDeadline(time.Time) error { return nil }
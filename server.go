@@ -1,74 +1,48 @@
 package main
 
 import (
-        "bufio"
-        "fmt"
-        "io"
-        "net"
-        "net/http"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
 )
 
 const (
-        publicAddr = ":8000"
-        tunnelAddr = ":8001"
+	publicAddr = ":8000"
+	tunnelAddr = ":8001"
 )
 
 func main() {
-        // Start tunnel listener
-        tunnelListener, err := net.Listen("tcp", tunnelAddr)
-        if err != nil {
-                fmt.Println("Error starting tunnel listener:", err)
-                return
-        }
-
-        // Accept tunnel connection
-        tunnelConn, err := tunnelListener.Accept()
-        if err != nil {
-                fmt.Println("Error accepting tunnel connection:", err)
-                return
-        }
-        defer tunnelConn.Close()
-
-        fmt.Println("Tunnel client connected")
-
-        // Start HTTP server
-        http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-                handleRequest(tunnelConn, w, r)
-        })
-
-        fmt.Println("Starting HTTP server on", publicAddr)
-        http.ListenAndServe(publicAddr, nil)
+	public := flag.String("public", publicAddr, "Public HTTP address")
+	tunnel := flag.String("tunnel", tunnelAddr, "Address the tunnel client connects to")
+	certFile := flag.String("cert", "", "Certificate for HTTPS and HTTP/2 over TLS on the public address (default plain HTTP/1.1 and h2c)")
+	keyFile := flag.String("key", "", "Key of -cert")
+	flag.Parse()
+
+	// Start tunnel listener
+	tunnelListener, err := net.Listen("tcp", *tunnel)
+	if err != nil {
+		fmt.Println("Error starting tunnel listener:", err)
+		return
+	}
+	go acceptTunnels(tunnelListener)
+
+	// Start HTTP server. Each request, and so each HTTP/2 stream, gets its
+	// own stream on the tunnel.
+	server := &http.Server{
+		Addr:      *public,
+		Handler:   http.HandlerFunc(handlePublicRequest),
+		Protocols: new(http.Protocols),
+	}
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetHTTP2(true)
+	if *certFile != "" {
+		fmt.Println("Starting HTTPS server (HTTP/1.1 and h2) on", *public)
+		err = server.ListenAndServeTLS(*certFile, *keyFile)
+	} else {
+		server.Protocols.SetUnencryptedHTTP2(true)
+		fmt.Println("Starting HTTP server (HTTP/1.1 and h2c) on", *public)
+		err = server.ListenAndServe()
+	}
+	fmt.Println("Error starting HTTP server:", err)
 }
-
-func handleRequest(tunnelConn net.Conn, w http.ResponseWriter, r *http.Request) {
-        // Forward request to tunnel client
-        err := r.Write(tunnelConn)
-        if err != nil {
-                fmt.Println("Error forwarding request:", err)
-                http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-                return
-        }
-
-        // Read response from tunnel client
-        resp, err := http.ReadResponse(bufio.NewReader(tunnelConn), r)
-        if err != nil {
-                fmt.Println("Error reading response:", err)
-                http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-                return
-        }
-        defer resp.Body.Close()
-
-        // Copy headers
-        for k, v := range resp.Header {
-                w.Header()[k] = v
-        }
-
-        // Set status code
-        w.WriteHeader(resp.StatusCode)
-
-        // Copy body
-        _, err = io.Copy(w, resp.Body)
-        if err != nil {
-                fmt.Println("Error copying response body:", err)
-        }
-}
\ No newline at end of file
@@ -2,8 +2,10 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -12,6 +14,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 )
@@ -23,9 +26,63 @@ var (
 	localPort      string
 	clientCertPath string
 	clientKeyPath  string
+	certPassword   string
+	certPassFile   string
+	secretsPath    string
+	secretKeyfile  string
 	logFilePath    string
 	bufferSize     int
 	useHTTP        bool
+	lbConfigPath   string
+	lbStrategy     string
+	healthInterval time.Duration
+	serverList     string
+	relaySelection string
+	failoverAfter  int
+	failbackAfter  time.Duration
+	controlAddr    string
+	proxyUser      string
+	proxyPass      string
+	enrollURL      string
+	enrollCA       string
+	enrollInsecure bool
+	proxyAllowList string
+	egressMode     bool
+	egressSessions int
+	serveDir       string
+	fileServerConf string
+	tunnelTTL      time.Duration
+	expireAt       string
+	scheduleSpec   string
+	rateUp         string
+	rateDown       string
+	fairShare      bool
+	quotaDaily     string
+	quotaMonthly   string
+	quotaPolicy    string
+	quotaFile      string
+	compress       bool
+	poolMin        int
+	poolMax        int
+	poolIdle       time.Duration
+	localTLSMode   bool
+	localSNI       string
+	localCA        string
+	localPins      string
+	localCert      string
+	localKey       string
+	localInsecure  bool
+	sniHost        string
+	relayTLS       bool
+	requestPort    int
+	rewriteConfig  string
+	publicPath     string
+	routesFile     string
+
+	localPool    *backendPool
+	httpRewrites *httpRewrite
+	relays       *relayList
+	proxyAllowed destAllowList
 )
 
 func init() {
@@ -33,19 +90,177 @@ func init() {
 	flag.StringVar(&serverPort, "server-port", "", "Server port")
 	flag.StringVar(&localIP, "local-ip", "", "Local IP address")
 	flag.StringVar(&localPort, "local-port", "", "Local port")
-	flag.StringVar(&clientCertPath, "cert", "", "Path to client certificate")
-	flag.StringVar(&clientKeyPath, "key", "", "Path to client key")
+	flag.StringVar(&clientCertPath, "cert", "", "Path to client certificate (PEM, or a .p12/.pfx bundle with key and chain)")
+	flag.StringVar(&clientKeyPath, "key", "", "Path to client key (not used with .p12/.pfx)")
+	flag.StringVar(&certPassword, "cert-password", "", "Password of a .p12/.pfx -cert (default $TUNNEL_CERT_PASSWORD)")
+	flag.StringVar(&certPassFile, "cert-password-file", "", "File holding the password of a .p12/.pfx -cert")
+	flag.StringVar(&secretsPath, "secret-store", "ssl_tunnel_secrets.json", "Encrypted store for secret:<name> values of -key, -local-key, -cert-password, -proxy-user and -proxy-pass")
+	flag.StringVar(&secretKeyfile, "secret-keyfile", "", "Keyfile of the secret store (default passphrase from $TUNNEL_STORE_PASSPHRASE or a prompt)")
+	flag.StringVar(&enrollURL, "enroll-url", "", "Relay enrollment endpoint for renewing -cert/-key before they expire, e.g. https://relay.example.com:3743")
+	flag.StringVar(&enrollCA, "enroll-ca", "", "CA certificate for the enrollment endpoint's TLS (default system roots)")
+	flag.BoolVar(&enrollInsecure, "enroll-insecure", false, "Do not verify the enrollment endpoint's certificate")
 	flag.StringVar(&logFilePath, "log", "ssl_tunnel.log", "Path to log file")
 	flag.IntVar(&bufferSize, "buffer", 4096, "Buffer size for data transfer")
 	flag.BoolVar(&useHTTP, "http", false, "Use HTTP/HTTPS instead of raw TCP")
+	flag.StringVar(&lbConfigPath, "lb-config", "", "Path to a JSON list of local backends (LoadBalance model) to use instead of -local-ip/-local-port")
+	flag.StringVar(&lbStrategy, "lb-strategy", "round-robin", "Load balancing strategy: round-robin, weighted, least-conn or source-hash")
+	flag.DurationVar(&healthInterval, "health-interval", 10*time.Second, "Interval between active backend health checks")
+	flag.StringVar(&serverList, "servers", "", "Comma-separated list of relays (ip:port) to use instead of -server-ip/-server-port")
+	flag.StringVar(&relaySelection, "relay-select", "order", "Relay selection: order (as listed) or latency (ranked by a startup RTT probe)")
+	flag.IntVar(&failoverAfter, "failover-after", 3, "Consecutive handshake failures before failing over to the next relay")
+	flag.DurationVar(&failbackAfter, "failback", 0, "Interval for probing preferred relays to fail back to (0 disables fail-back)")
+	flag.StringVar(&controlAddr, "control", "", "Address for the local control API, e.g. 127.0.0.1:4040")
+	flag.StringVar(&proxyUser, "proxy-user", "", "Username required by the HTTP CONNECT/SOCKS5 proxy in HTTP mode")
+	flag.StringVar(&proxyPass, "proxy-pass", "", "Password required by the HTTP CONNECT/SOCKS5 proxy in HTTP mode")
+	flag.StringVar(&proxyAllowList, "proxy-allow", "", "Comma-separated destinations the proxy or egress sessions may reach, e.g. 10.0.0.0/8,*.lan:80 (egress reaches loopback and private networks only when named)")
+	flag.BoolVar(&egressMode, "egress", false, "Serve as an exit for the relay's rotating proxy service instead of exposing a local service")
+	flag.IntVar(&egressSessions, "egress-sessions", 4, "Number of idle egress sessions to keep at the relay")
+	flag.StringVar(&serveDir, "serve-dir", "", "Serve this local directory through the tunnel instead of a local service")
+	flag.StringVar(&fileServerConf, "file-server-config", "", "Path to a JSON file server config (SettingFileServer model) with per-user permissions, required by -serve-dir")
+	flag.DurationVar(&tunnelTTL, "ttl", 0, "Close the tunnel after this long, e.g. 2h (0 keeps it open)")
+	flag.StringVar(&expireAt, "expire-at", "", "Close the tunnel at this time (RFC 3339, e.g. 2024-05-01T18:00:00+02:00)")
+	flag.StringVar(&scheduleSpec, "schedule", "", "Only keep the tunnel up during these local windows, e.g. \"Mon-Fri 09:00-17:30;Sat 10:00-12:00\"")
+	flag.BoolVar(&relayDeadline, "relay-deadline", false, "Tell the relay when -ttl, -expire-at or -schedule ends so it closes the public side too (needs the Go relay)")
+	flag.StringVar(&rateUp, "rate-up", "", "Upload rate limit to the relay in bytes per second, e.g. 256K (empty is unlimited)")
+	flag.StringVar(&rateDown, "rate-down", "", "Download rate limit from the relay in bytes per second, e.g. 2M (empty is unlimited)")
+	flag.BoolVar(&fairShare, "fair-share", false, "Split the rate limits evenly between concurrent streams")
+	flag.StringVar(&quotaDaily, "quota-daily", "", "Daily data quota for both directions, e.g. 500M")
+	flag.StringVar(&quotaMonthly, "quota-monthly", "", "Monthly data quota for both directions, e.g. 20G")
+	flag.StringVar(&quotaPolicy, "quota-policy", "pause", "What to do when a quota is exhausted: pause (hold traffic) or close (disconnect until it resets)")
+	flag.BoolVar(&compress, "compress", false, "Offer DEFLATE stream compression to the relay (needs the Go relay)")
+	flag.IntVar(&poolMin, "pool-min", 0, "Warm sessions to keep idle at the relay for new connections (0 connects one at a time; needs the Go relay)")
+	flag.IntVar(&poolMax, "pool-max", 16, "Upper bound of warm and active sessions together")
+	flag.DurationVar(&poolIdle, "pool-idle", 5*time.Minute, "Replace warm sessions that stayed idle this long (0 keeps them)")
+	flag.BoolVar(&localTLSMode, "local-tls", false, "Speak TLS to the local target (like IsSslStream in -lb-config)")
+	flag.StringVar(&localSNI, "local-sni", "", "Server name sent to and verified against TLS local targets (default the target address)")
+	flag.StringVar(&localCA, "local-ca", "", "PEM file with the CA certificates trusted for TLS local targets (default system roots)")
+	flag.StringVar(&localPins, "local-pin", "", "Comma-separated sha256/<base64> public key pins for TLS local targets")
+	flag.StringVar(&localCert, "local-cert", "", "Client certificate presented to TLS local targets")
+	flag.StringVar(&localKey, "local-key", "", "Key of the client certificate presented to TLS local targets")
+	flag.BoolVar(&localInsecure, "local-insecure", false, "Do not verify the certificate of TLS local targets")
+	flag.IntVar(&requestPort, "public-port", 0, "Ask the relay for this public port (needs a Go relay with -port-range; default its reservation for this certificate)")
+	flag.StringVar(&sniHost, "sni-host", "", "Register this hostname (or *.domain) on the relay's shared TLS port; TLS is passed through to the local target (needs the Go relay)")
+	flag.BoolVar(&relayTLS, "relay-tls", false, "With -sni-host, have the relay terminate TLS with its own certificate (ACME or file) and forward plaintext to the local target")
+	flag.Var(&remoteForwardSpecs, "R", "Remote forward public:local, exposing a local port or host:port on the relay's public port (0 for any; repeatable, needs a Go relay with -port-range)")
+	flag.Var(&localForwardSpecs, "L", "Local forward [bind:]localport:relayhost:port, reaching host:port on the relay's network (repeatable, needs the Go relay)")
+	flag.BoolVar(&p2pEnabled, "p2p", false, "With -R/-L, connect directly to other clients of the relay when possible, falling back to the relay")
+	flag.IntVar(&p2pPort, "p2p-port", 0, "TCP port for direct connections from other clients (default a random port)")
+	flag.StringVar(&transport, "transport", "tls", "Transport to the relay: tls (raw TLS) or wss (WebSocket over TLS; needs the Go relay)")
+	flag.StringVar(&rewriteConfig, "rewrite-config", "", "JSON file with header, path, Location and Set-Cookie rewrite rules for -http")
+	flag.StringVar(&publicPath, "path", "", "With -http, path prefix the tunnel is served under, stripped before the relay (like ClientRelayPort.Path)")
+	flag.StringVar(&routesFile, "routes", "", "JSON routing table sending the HTTP requests of the tunnel to local services by path, instead of -local-ip/-local-port")
+	flag.StringVar(&wsPath, "ws-path", "/tunnel", "Request path of the WebSocket transport")
+	flag.StringVar(&relayProxyFlag, "relay-proxy", "", "Proxy for reaching the relay: http://, https://, socks5:// or socks5h:// with optional user:pass@, or direct (default $HTTPS_PROXY, $HTTP_PROXY or $ALL_PROXY unless $NO_PROXY matches)")
+	flag.StringVar(&quotaFile, "quota-file", "ssl_tunnel_quota.json", "Path to the file keeping quota usage across restarts")
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "cert" {
+		if err := runCertCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "secret" {
+		if err := runSecretCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	flag.Parse()
 
-	if serverIP == "" || serverPort == "" || localIP == "" || localPort == "" || clientCertPath == "" || clientKeyPath == "" {
+	if (serverList == "" && (serverIP == "" || serverPort == "")) || clientCertPath == "" || (clientKeyPath == "" && !isPKCS12(clientCertPath)) {
 		log.Fatal("All parameters must be provided. Use -h for help.")
 	}
+	if usesSecrets(clientKeyPath, localKey, certPassword, proxyUser, proxyPass) {
+		var err error
+		if secrets, err = openSecretStore(secretsPath, secretKeyfile, false); err != nil {
+			log.Fatal(err)
+		}
+		for _, v := range []*string{&proxyUser, &proxyPass} {
+			if *v, err = resolveSecret(*v); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	if err := resolveCertPassword(); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := loadClientCert(); err != nil {
+		log.Fatalf("Failed to load client certificate: %v", err)
+	}
+	if enrollURL != "" && (isPKCS12(clientCertPath) || usesSecrets(clientKeyPath)) {
+		log.Fatal("-enroll-url renews PEM -cert/-key files, not .p12/.pfx bundles or secret keys")
+	}
+
+	for _, spec := range remoteForwardSpecs {
+		f, err := parseRemoteForward(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		remoteForwards = append(remoteForwards, f)
+	}
+	for _, spec := range localForwardSpecs {
+		f, err := parseLocalForward(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		localForwards = append(localForwards, f)
+	}
+	forwarding := len(remoteForwards) > 0 || len(localForwards) > 0
+	if forwarding && (useHTTP || egressMode || poolMin > 0 || sniHost != "" || serveDir != "" || lbConfigPath != "" || requestPort > 0 || routesFile != "") {
+		log.Fatal("-R and -L cannot be combined with -http, -egress, -pool-min, -sni-host, -serve-dir, -lb-config, -routes or -public-port")
+	}
+	if routesFile != "" && (useHTTP || egressMode || serveDir != "" || lbConfigPath != "") {
+		log.Fatal("-routes cannot be combined with -http, -egress, -serve-dir or -lb-config")
+	}
+
+	if p2pEnabled && !forwarding {
+		log.Fatal("-p2p needs -R or -L")
+	}
+
+	if !forwarding && lbConfigPath == "" && serveDir == "" && routesFile == "" && !egressMode && (localIP == "" || localPort == "") {
+		log.Fatal("Local IP and port or -lb-config must be provided. Use -h for help.")
+	}
+
+	if transport != "tls" && transport != "wss" {
+		log.Fatalf("Invalid -transport %q, expected tls or wss", transport)
+	}
+	if transport == "wss" && useHTTP {
+		log.Fatal("-transport wss does not apply to -http")
+	}
+	if relayProxyFlag != "" && relayProxyFlag != "direct" {
+		if _, err := parseProxyURL(relayProxyFlag); err != nil {
+			log.Fatalf("Invalid -relay-proxy: %v", err)
+		}
+	}
+
+	if (rewriteConfig != "" || publicPath != "") && !useHTTP {
+		log.Fatal("-rewrite-config and -path need -http")
+	}
+	if rewriteConfig != "" {
+		var err error
+		if httpRewrites, err = loadRewrite(rewriteConfig); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if publicPath != "" {
+		if httpRewrites == nil {
+			httpRewrites = &httpRewrite{}
+		}
+		httpRewrites.Path = publicPath
+		if err := httpRewrites.check(); err != nil {
+			log.Fatalf("Invalid -path: %v", err)
+		}
+	}
+
+	if relayTLS && sniHost == "" {
+		log.Fatal("-relay-tls needs -sni-host")
+	}
+
+	if bufferSize > 0 {
+		copyBufferSize = bufferSize
+	}
 
 	// Set up logging
 	logFile, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -61,17 +276,161 @@ func main() {
 	go func() {
 		<-sigChan
 		log.Println("Received shutdown signal. Closing tunnel...")
+		tunnelShaper.save()
+		if secrets != nil {
+			secrets.wipe()
+		}
 		os.Exit(0)
 	}()
 
+	localTLS, err = buildLocalTLS(localSNI, localCA, localPins, localCert, localKey, localInsecure)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !useHTTP && !egressMode && !forwarding {
+		members := []loadBalance{{Ip: localIP, IsSslStream: &localTLSMode}}
+		if serveDir != "" {
+			settings, err := loadFileServerSettings(fileServerConf)
+			if err != nil {
+				log.Fatal(err)
+			}
+			addr, err := startFileServer(serveDir, settings)
+			if err != nil {
+				log.Fatal(err)
+			}
+			host, port, _ := net.SplitHostPort(addr)
+			members[0].Ip = host
+			members[0].IsSslStream = nil
+			members[0].Port, _ = strconv.Atoi(port)
+		} else if routesFile != "" {
+			table, err := loadRoutes(routesFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			addr, err := startRouter(table)
+			if err != nil {
+				log.Fatal(err)
+			}
+			host, port, _ := net.SplitHostPort(addr)
+			members[0].Ip = host
+			members[0].IsSslStream = nil
+			members[0].Port, _ = strconv.Atoi(port)
+		} else if lbConfigPath != "" {
+			members, err = loadBackends(lbConfigPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+		} else if members[0].Port, err = strconv.Atoi(localPort); err != nil {
+			log.Fatalf("Invalid local port %q", localPort)
+		}
+
+		localPool, err = newBackendPool(lbStrategy, members)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go localPool.runHealthChecks(healthInterval)
+	}
+
+	if serverList == "" {
+		serverList = net.JoinHostPort(serverIP, serverPort)
+	}
+	defaultPort := serverPort
+	if defaultPort == "" {
+		defaultPort = "3742"
+	}
+	relayEntries, err := parseRelays(serverList, defaultPort)
+	if err != nil {
+		log.Fatal(err)
+	}
+	relays, err = newRelayList(relayEntries, relaySelection, failoverAfter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if failbackAfter > 0 {
+		go relays.failBack(failbackAfter)
+	}
+
+	if tunnelTTL > 0 {
+		tunnelExpiresAt = time.Now().Add(tunnelTTL)
+	}
+	if expireAt != "" {
+		t, err := time.Parse(time.RFC3339, expireAt)
+		if err != nil {
+			log.Fatalf("Invalid -expire-at: %v", err)
+		}
+		if tunnelExpiresAt.IsZero() || t.Before(tunnelExpiresAt) {
+			tunnelExpiresAt = t
+		}
+	}
+	if !tunnelExpiresAt.IsZero() {
+		log.Printf("Tunnel expires at %s", tunnelExpiresAt.Format(time.RFC3339))
+	}
+	if scheduleSpec != "" {
+		tunnelSchedule, err = parseSchedule(scheduleSpec)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if relayDeadline && tunnelExpiresAt.IsZero() && tunnelSchedule == nil {
+		log.Fatal("-relay-deadline needs -ttl, -expire-at or -schedule")
+	}
+
+	sizes := []string{rateUp, rateDown, quotaDaily, quotaMonthly}
+	limits := make([]int64, len(sizes))
+	for i, size := range sizes {
+		if limits[i], err = parseByteSize(size); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := tunnelShaper.configure(limits[0], limits[1], fairShare, limits[2], limits[3], quotaPolicy, quotaFile); err != nil {
+		log.Fatal(err)
+	}
+
+	proxyAllowed, err = parseDestAllowList(proxyAllowList)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if controlAddr != "" {
+		startControlAPI(controlAddr)
+	}
+
+	if enrollURL != "" {
+		go renewClientCert(enrollURL, enrollCA, enrollInsecure)
+	}
+
 	log.Println("Starting SSL tunnel...")
 
+	if egressMode {
+		runEgress(egressSessions)
+	}
+	if forwarding {
+		if p2pEnabled {
+			if err := startP2P(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		runForwards()
+	}
+
+	if poolMin > 0 && !useHTTP {
+		warmPool, err = newTunnelPool(poolMin, poolMax, poolIdle)
+		if err != nil {
+			log.Fatal(err)
+		}
+		warmPool.run()
+	}
+
 	for {
+		waitUntilActive()
+		tunnelShaper.waitForQuota()
+
 		var err error
 		if useHTTP {
 			err = connectAndForwardHTTP()
 		} else {
-			err = connectAndForwardTCP()
+			err = connectAndForwardTCP(nil)
 		}
 		if err != nil {
 			log.Printf("Error: %v\n", err)
@@ -81,8 +440,11 @@ func main() {
 	}
 }
 
-func connectAndForwardTCP() error {
-	cert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+// connectAndForwardTCP runs one tunnel session. Warm sessions from the pool
+// wait for the relay to hand them a public connection before dialing the
+// local endpoint.
+func connectAndForwardTCP(warm *warmSession) error {
+	cert, err := loadClientCert()
 	if err != nil {
 		return fmt.Errorf("failed to load client certificate: %v", err)
 	}
@@ -91,46 +453,117 @@ func connectAndForwardTCP() error {
 		Certificates:       []tls.Certificate{cert},
 		InsecureSkipVerify: true,
 	}
-	conn, err := tls.Dial("tcp", serverIP+":"+serverPort, config)
+	relayAddr := relays.currentAddr()
+	conn, err := dialRelay(relayAddr, config)
 	if err != nil {
-		return fmt.Errorf("failed to connect to server: %v", err)
+		relays.reportFailure(relayAddr)
+		return fmt.Errorf("failed to connect to server %s: %v", relayAddr, err)
 	}
 	defer conn.Close()
 
-	log.Println("Connected to server and SSL handshake completed.")
+	log.Printf("Connected to server %s and SSL handshake completed.\n", relayAddr)
+	defer closeAtDeadline(conn)()
 
-	key := []byte{0x00, 0x08, 0x00, 0x00, 0x00, 0x22, 0x4D, 0x00, 0x00, 0x00}
-	if _, err = conn.Write(key); err != nil {
-		return fmt.Errorf("failed to send initial key: %v", err)
+	var receivedServerPort uint32
+	var compression string
+	hello := deadlineHello()
+	if compress {
+		if hello == nil {
+			hello = &tunnelHello{}
+		}
+		hello.Compression = []string{compressionDeflate}
 	}
-	log.Println("Sent initial key.")
-
-	response := make([]byte, 20)
-	if _, err = io.ReadFull(conn, response); err != nil {
-		return fmt.Errorf("failed to receive response from server: %v", err)
+	if sniHost != "" {
+		if hello == nil {
+			hello = &tunnelHello{}
+		}
+		hello.Hostname = sniHost
+		hello.Terminate = relayTLS
+	}
+	if requestPort > 0 {
+		if hello == nil {
+			hello = &tunnelHello{}
+		}
+		hello.Port = requestPort
 	}
-	log.Printf("Received response from server: %x\n", response)
+	if warm != nil {
+		if hello == nil {
+			hello = &tunnelHello{}
+		}
+		hello.Pool = true
+		hello.PoolIdleSeconds = int(warm.pool.idleTimeout.Seconds())
+	}
+	if hello != nil {
+		// Anything beyond the plain key needs the extended hello (Go relay)
+		if err = writeHello(conn, hello); err != nil {
+			relays.reportFailure(relayAddr)
+			return fmt.Errorf("failed to send hello: %v", err)
+		}
+		port, reply, err := readReply(conn)
+		if err != nil {
+			relays.reportFailure(relayAddr)
+			return err
+		}
+		if reply.Error != "" {
+			return fmt.Errorf("server refused tunnel: %s", reply.Error)
+		}
+		receivedServerPort = uint32(port)
+		compression = reply.Compression
+	} else {
+		key := []byte{0x00, 0x08, 0x00, 0x00, 0x00, 0x22, 0x4D, 0x00, 0x00, 0x00}
+		if _, err = conn.Write(key); err != nil {
+			relays.reportFailure(relayAddr)
+			return fmt.Errorf("failed to send initial key: %v", err)
+		}
+		log.Println("Sent initial key.")
+
+		response := make([]byte, 20)
+		if _, err = io.ReadFull(conn, response); err != nil {
+			relays.reportFailure(relayAddr)
+			return fmt.Errorf("failed to receive response from server: %v", err)
+		}
+		log.Printf("Received response from server: %x\n", response)
 
-	receivedServerPort := binary.BigEndian.Uint32(response[16:20])
+		receivedServerPort = binary.BigEndian.Uint32(response[16:20])
+	}
 	log.Printf("Server is listening on port: %d\n", receivedServerPort)
+	publicHost, _, _ := net.SplitHostPort(relayAddr)
+	if sniHost != "" {
+		publicHost = sniHost
+	}
+	relays.reportSuccess(relayAddr, net.JoinHostPort(publicHost, strconv.Itoa(int(receivedServerPort))))
+
+	source := ""
+	if warm != nil {
+		start, err := warm.waitForStream(conn)
+		if err != nil {
+			return err
+		}
+		source = start.Remote
+	}
 
-	localConn, err := net.Dial("tcp", localIP+":"+localPort)
+	localConn, err := localPool.dial(source)
 	if err != nil {
 		return fmt.Errorf("failed to connect to local endpoint: %v", err)
 	}
 	defer localConn.Close()
 
-	log.Println("Connected to local endpoint. Forwarding traffic...")
+	log.Printf("Connected to local endpoint %s. Forwarding traffic...\n", localConn.RemoteAddr())
 
-	errChan := make(chan error, 2)
-	go forward(conn, localConn, "Server -> Local", errChan)
-	go forward(localConn, conn, "Local -> Server", errChan)
+	relayConn := tunnelShaper.shapeConn(conn)
+	defer relayConn.Close()
+	if compression != "" {
+		log.Printf("Using %s compression", compression)
+		relayConn = newCompressedConn(relayConn)
+	}
 
-	return <-errChan
+	toLocal, toServer, err := pipeConns(localConn, relayConn)
+	log.Printf("Connection closed. Server -> Local: %d bytes, Local -> Server: %d bytes\n", toLocal, toServer)
+	return err
 }
 
 func connectAndForwardHTTP() error {
-	cert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+	cert, err := loadClientCert()
 	if err != nil {
 		return fmt.Errorf("failed to load client certificate: %v", err)
 	}
@@ -142,10 +575,22 @@ func connectAndForwardHTTP() error {
 
 	transport := &http.Transport{
 		TLSClientConfig: config,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialRelay(addr, config)
+			if err != nil {
+				return nil, err
+			}
+			return tunnelShaper.shapeConn(conn), nil
+		},
 	}
 
 	client := &http.Client{
 		Transport: transport,
+		// Redirects go back to the local client, rewritten by -path and
+		// -rewrite-config
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
 	}
 
 	localListener, err := net.Listen("tcp", localIP+":"+localPort)
@@ -155,9 +600,13 @@ func connectAndForwardHTTP() error {
 	defer localListener.Close()
 
 	log.Printf("Listening on %s:%s\n", localIP, localPort)
+	defer closeAtDeadline(localListener)()
 
 	for {
 		localConn, err := localListener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
 			log.Printf("Error accepting connection: %v\n", err)
 			continue
@@ -171,41 +620,52 @@ func handleHTTPConnection(localConn net.Conn, client *http.Client) {
 	defer localConn.Close()
 
 	reader := bufio.NewReader(localConn)
+	if first, err := reader.Peek(1); err == nil && first[0] == socks5Version {
+		handleSOCKS5(localConn, reader)
+		return
+	}
+
 	req, err := http.ReadRequest(reader)
 	if err != nil {
 		log.Printf("Error reading request: %v\n", err)
 		return
 	}
 
+	// Forward-proxy requests are sent to the destination through the relay
+	if req.Method == http.MethodConnect {
+		handleHTTPConnect(localConn, reader, req)
+		return
+	}
+	if req.URL.IsAbs() {
+		handleHTTPProxy(localConn, reader, req)
+		return
+	}
+
+	relayAddr := relays.currentAddr()
+	var scope *rewriteScope
+	if httpRewrites != nil {
+		var ok bool
+		if scope, ok = httpRewrites.rewriteRequest(req, relayAddr); !ok {
+			io.WriteString(localConn, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+	}
 	req.URL.Scheme = "https"
-	req.URL.Host = serverIP + ":" + serverPort
+	req.URL.Host = relayAddr
+	req.RequestURI = ""
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("Error sending request to server: %v\n", err)
+		relays.reportFailure(relayAddr)
+		log.Printf("Error sending request to server %s: %v\n", relayAddr, err)
 		return
 	}
 	defer resp.Body.Close()
+	relays.reportSuccess(relayAddr, relayAddr)
+	if scope != nil {
+		scope.rewriteResponse(resp)
+	}
 
 	resp.Write(localConn)
 	log.Printf("Forwarded request: %s %s\n", req.Method, req.URL)
 }
-
-func forward(src, dst net.Conn, direction string, errChan chan<- error) {
-	buffer := make([]byte, bufferSize)
-	for {
-		n, err := src.Read(buffer)
-		if err != nil {
-			if err != io.EOF {
-				errChan <- fmt.Errorf("%s read error: %v", direction, err)
-			}
-			break
-		}
-		_, err = dst.Write(buffer[:n])
-		if err != nil {
-			errChan <- fmt.Errorf("%s write error: %v", direction, err)
-			break
-		}
-		log.Printf("%s: Forwarded %d bytes\n", direction, n)
-	}
-}
\ No newline at end of file
@@ -4,7 +4,6 @@ import (
 	"crypto/tls"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
@@ -104,7 +103,9 @@ func connectAndForward() error {
     log.Println("Connected to server successfully.")
 
 	log.Println("Connected to server successfully.")
-	log.Printf("Using TLS version: %s", versionToString(serverConn.(*tls.Conn).ConnectionState().Version))
+	if tlsConn, ok := serverConn.(*tls.Conn); ok {
+		log.Printf("Using TLS version: %s", versionToString(tlsConn.ConnectionState().Version))
+	}
 
 	localConn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", localIP, localPort))
 	if err != nil {
@@ -114,22 +115,10 @@ func connectAndForward() error {
 
 	log.Printf("Connected to local service at %s:%s", localIP, localPort)
 
-	// Forward traffic in both directions
-	errChan := make(chan error, 2)
-
-	go func() {
-		_, err := io.Copy(serverConn, localConn)
-		errChan <- err
-	}()
-
-	go func() {
-		_, err := io.Copy(localConn, serverConn)
-		errChan <- err
-	}()
-
-	// Wait for an error or EOF from either direction
-	err = <-errChan
-	if err != nil && err != io.EOF {
+	// Forward traffic in both directions; between plain TCP sockets this
+	// splices without copying through user space
+	_, _, err = pipeConns(serverConn, localConn)
+	if err != nil {
 		return fmt.Errorf("error during data transfer: %v", err)
 	}
 
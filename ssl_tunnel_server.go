@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	listenAddr         string
+	serverCertPath     string
+	serverKeyPath      string
+	publicPort         int
+	allowedThumbprints string
+	allowedDests       string
+	logFilePath        string
+	proxyListenAddr    string
+	proxyTokens        string
+	rotateEvery        time.Duration
+	adminAddr          string
+	adminToken         string
+	sniListenAddr      string
+	sniPort            int
+	tlsCertPairs       string
+	acmeDirectory      string
+	acmeEmail          string
+	acmeCA             string
+	acmeCache          string
+	acmeDomains        string
+	acmeChallenge      string
+	acmeHTTPListenAddr string
+	enrollListenAddr   string
+	enrollCACert       string
+	enrollCAKey        string
+	enrollDB           string
+	enrollValidity     time.Duration
+	portRange          string
+	portReservations   string
+
+	destAllowed    destAllowList
+	thumbprints    map[string]bool
+	publicSessions = make(chan net.Conn)
+)
+
+func init() {
+	flag.StringVar(&listenAddr, "listen", ":3742", "Address for tunnel clients to connect to")
+	flag.StringVar(&serverCertPath, "cert", "server.crt", "Path to server certificate")
+	flag.StringVar(&serverKeyPath, "key", "server.key", "Path to server key")
+	flag.IntVar(&publicPort, "public-port", 5900, "Public port forwarded to tunnel clients")
+	flag.StringVar(&portRange, "port-range", "", "Give each client certificate its own public port from this range, e.g. 20000-20999 (replaces -public-port)")
+	flag.StringVar(&portReservations, "port-reservations", "ssl_relay_ports.json", "File keeping the public port reserved for each client certificate")
+	flag.StringVar(&allowedThumbprints, "allow-thumbprint", "", "Comma-separated SHA-1 thumbprints of allowed client certificates (empty allows any)")
+	flag.StringVar(&allowedDests, "allow-dest", "", "Comma-separated destinations clients may connect to through the relay, e.g. 10.0.0.0/8,*.lan:80")
+	flag.StringVar(&logFilePath, "log", "", "Path to log file (default stderr)")
+	flag.StringVar(&proxyListenAddr, "proxy-listen", "", "Address for the rotating egress proxy service, e.g. :3128")
+	flag.StringVar(&proxyTokens, "proxy-token", "", "Comma-separated name:secret tokens for the proxy service")
+	flag.DurationVar(&rotateEvery, "rotate-every", 0, "Rotate each proxy session to another egress client after this long (0 keeps it sticky)")
+	flag.StringVar(&sniListenAddr, "sni-listen", "", "Shared TLS listener routed by SNI to clients that registered a hostname, e.g. :443")
+	flag.StringVar(&tlsCertPairs, "tls-cert", "", "Comma-separated cert.pem:key.pem pairs (e.g. wildcard certificates) for hostnames the relay terminates TLS for")
+	flag.StringVar(&acmeDirectory, "acme-directory", "", "ACME directory URL for certificates of terminated hostnames, e.g. https://localhost:14000/dir for Pebble")
+	flag.StringVar(&acmeEmail, "acme-email", "", "Contact email for the ACME account")
+	flag.StringVar(&acmeCA, "acme-ca", "", "CA certificate for the ACME server's own TLS (private CAs, Pebble)")
+	flag.StringVar(&acmeCache, "acme-cache", "acme-cache", "Directory for the ACME account key and issued certificates")
+	flag.StringVar(&acmeDomains, "acme-domains", "", "Comma-separated domains certificates may be requested for (empty allows any registered hostname)")
+	flag.StringVar(&acmeChallenge, "acme-challenge", "tls-alpn-01", "ACME challenge: tls-alpn-01 (answered on -sni-listen, must be reachable on 443) or http-01")
+	flag.StringVar(&acmeHTTPListenAddr, "acme-http-listen", "", "Address answering HTTP-01 challenges and redirecting to HTTPS, e.g. :80")
+	flag.StringVar(&enrollListenAddr, "enroll-listen", "", "HTTPS address where clients enroll with a bootstrap token and renew their certificates, e.g. :3743")
+	flag.StringVar(&enrollCACert, "enroll-ca-cert", "", "CA certificate that signs enrolled client certificates")
+	flag.StringVar(&enrollCAKey, "enroll-ca-key", "", "Key of the enrollment CA")
+	flag.StringVar(&enrollDB, "enroll-db", "ssl_relay_enroll.json", "File keeping bootstrap tokens and issued client certificates")
+	flag.DurationVar(&enrollValidity, "enroll-validity", 90*24*time.Hour, "Lifetime of enrolled client certificates")
+	flag.StringVar(&adminAddr, "admin", "", "Address for the admin API, e.g. 127.0.0.1:4041")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token required on the admin API (needed unless -admin is a loopback address)")
+}
+
+func main() {
+	flag.Parse()
+
+	if logFilePath != "" {
+		logFile, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer logFile.Close()
+		log.SetOutput(logFile)
+	}
+
+	var err error
+	destAllowed, err = parseDestAllowList(allowedDests)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	thumbprints = make(map[string]bool)
+	for _, t := range strings.Split(allowedThumbprints, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			thumbprints[strings.ToUpper(t)] = true
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(serverCertPath, serverKeyPath)
+	if err != nil {
+		log.Fatalf("Failed to load server certificate: %v", err)
+	}
+
+	if enrollListenAddr != "" {
+		enrollment, err = newEnrollService(enrollCACert, enrollCAKey, enrollDB, enrollValidity)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := enrollment.start(enrollListenAddr, cert); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(thumbprints) == 0 && enrollment == nil {
+		log.Println("No -allow-thumbprint given, accepting any client certificate")
+	}
+
+	config := &tls.Config{
+		Certificates:          []tls.Certificate{cert},
+		ClientAuth:            tls.RequireAnyClientCert,
+		MinVersion:            tls.VersionTLS12,
+		VerifyPeerCertificate: verifyClientCertificate,
+	}
+
+	listener, err := tls.Listen("tcp", listenAddr, config)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", listenAddr, err)
+	}
+	log.Printf("Tunnel listening on %s", listenAddr)
+
+	if portRange != "" {
+		relayPorts, err = newPortAllocator(portRange, portReservations)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Allocating public ports from %s per client", portRange)
+	} else {
+		publicListener, err := net.Listen("tcp", fmt.Sprintf(":%d", publicPort))
+		if err != nil {
+			log.Fatalf("Failed to listen on public port %d: %v", publicPort, err)
+		}
+		log.Printf("Forwarding public port %d to tunnel clients", publicPort)
+		go acceptPublic(publicListener)
+	}
+
+	if sniListenAddr != "" {
+		sniListener, err := net.Listen("tcp", sniListenAddr)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", sniListenAddr, err)
+		}
+		sniPort = sniListener.Addr().(*net.TCPAddr).Port
+		log.Printf("Routing TLS connections on %s by server name", sniListenAddr)
+		go acceptSNI(sniListener)
+
+		if tlsCertPairs != "" || acmeDirectory != "" {
+			relayCerts, err = newCertManager(tlsCertPairs, acmeCache, acmeDomains)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if acmeDirectory != "" {
+			if err := relayCerts.enableACME(acmeDirectory, acmeEmail, acmeChallenge, acmeCA); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if acmeHTTPListenAddr != "" {
+			if relayCerts == nil {
+				log.Fatal("-acme-http-listen needs -acme-directory")
+			}
+			go func() {
+				log.Printf("Answering HTTP-01 challenges on %s", acmeHTTPListenAddr)
+				log.Fatal(http.ListenAndServe(acmeHTTPListenAddr, http.HandlerFunc(relayCerts.serveHTTPChallenge)))
+			}()
+		}
+	} else if tlsCertPairs != "" || acmeDirectory != "" {
+		log.Fatal("-tls-cert and -acme-directory need -sni-listen")
+	}
+
+	if proxyListenAddr != "" {
+		if err := startProxyService(proxyListenAddr, proxyTokens, rotateEvery); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if adminAddr != "" {
+		if err := startAdminAPI(adminAddr, adminToken); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Handle graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		log.Println("Received shutdown signal. Closing relay...")
+		os.Exit(0)
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Error accepting connection: %v", err)
+			continue
+		}
+		go handleClient(conn)
+	}
+}
+
+func verifyClientCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no client certificate")
+	}
+	thumbprint := certThumbprint(rawCerts[0])
+	if enrollment != nil {
+		// Enrolled certificates extend the static list, revocation wins
+		if enrollment.revoked(thumbprint) {
+			log.Printf("Client certificate %s is revoked", thumbprint)
+			return fmt.Errorf("client certificate %s revoked", thumbprint)
+		}
+		if enrollment.allowed(thumbprint) {
+			return nil
+		}
+	}
+	if (len(thumbprints) > 0 || enrollment != nil) && !thumbprints[thumbprint] {
+		log.Printf("Client certificate is not in the list of allowed certificates. Thumbprint: %s", thumbprint)
+		return fmt.Errorf("client certificate %s not allowed", thumbprint)
+	}
+	return nil
+}
+
+func acceptPublic(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Error accepting public connection: %v", err)
+			continue
+		}
+
+		go offerPublic(conn, publicSessions)
+	}
+}
+
+// offerPublic hands a public connection to the next tunnel session.
+func offerPublic(conn net.Conn, sessions chan net.Conn) {
+	select {
+	case sessions <- conn:
+	case <-time.After(10 * time.Second):
+		log.Printf("No tunnel client available for %s", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+func handleClient(conn net.Conn) {
+	defer conn.Close()
+
+	tlsConn := conn.(*tls.Conn)
+	tlsConn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("SSL/TLS authentication failed for %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	thumbprint := certThumbprint(tlsConn.ConnectionState().PeerCertificates[0].Raw)
+	if enrollment != nil {
+		defer enrollment.track(thumbprint, conn)()
+	}
+
+	// WebSocket clients send an HTTP upgrade first; the tunnel protocol
+	// follows inside the WebSocket
+	reader := bufio.NewReader(conn)
+	if first, err := reader.Peek(1); err == nil && first[0] == 'G' {
+		if conn, err = acceptWebSocket(conn, reader); err != nil {
+			log.Printf("Invalid WebSocket upgrade from %s: %v. Closing connection.", tlsConn.RemoteAddr(), err)
+			return
+		}
+		defer conn.Close()
+	} else if reader.Buffered() > 0 {
+		conn = &readerConn{Conn: conn, r: reader}
+	}
+
+	hello, err := readHello(conn)
+	if err != nil {
+		log.Printf("Invalid handshake from %s: %v. Closing connection.", conn.RemoteAddr(), err)
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	if hello != nil && hello.Connect != "" {
+		handleConnect(conn, clientIP, hello)
+		return
+	}
+	if hello != nil && hello.Egress {
+		registerEgress(conn, clientIP, thumbprint, hello)
+		return
+	}
+	if hello != nil && hello.Mux {
+		handleMux(conn, clientIP, thumbprint, hello)
+		return
+	}
+
+	var reply *tunnelReply
+	var expired <-chan time.Time
+	port, sessions := publicPort, publicSessions
+	if hello != nil {
+		reply = &tunnelReply{Compression: negotiateCompression(hello.Compression)}
+		if hello.TotalMinutes != nil {
+			expiresAt := hello.StartedTime.Add(time.Duration(*hello.TotalMinutes) * time.Minute)
+			if !time.Now().Before(expiresAt) {
+				reply.Error = "tunnel expired at " + expiresAt.Format(time.RFC3339)
+			} else {
+				timer := time.NewTimer(time.Until(expiresAt))
+				defer timer.Stop()
+				expired = timer.C
+			}
+		}
+		if hello.Hostname != "" && reply.Error == "" {
+			if sniListenAddr == "" {
+				reply.Error = "SNI routing is not enabled on this relay"
+			} else if hello.Terminate && relayCerts == nil {
+				reply.Error = "TLS termination is not enabled on this relay"
+			} else {
+				route, err := registerSNI(hello.Hostname, thumbprint, hello.Terminate)
+				if err != nil {
+					reply.Error = err.Error()
+				} else {
+					defer releaseSNI(hello.Hostname)
+					port, sessions = sniPort, route.sessions
+				}
+			}
+		} else if hello.Port != 0 && relayPorts == nil && reply.Error == "" {
+			reply.Error, reply.Code = "port allocation is not enabled on this relay", "refused"
+		}
+	}
+	if relayPorts != nil && (hello == nil || hello.Hostname == "") && (reply == nil || reply.Error == "") {
+		requested := 0
+		if hello != nil {
+			requested = hello.Port
+		}
+		route, err := relayPorts.acquire(thumbprint, requested)
+		if err != nil {
+			if reply == nil {
+				// Clients with the original handshake cannot be told why
+				log.Printf("No public port for %s: %v", clientIP, err)
+				return
+			}
+			reply.Error, reply.Code = err.Error(), "refused"
+		} else {
+			defer relayPorts.release(route)
+			port, sessions = route.port, route.sessions
+		}
+	}
+	if err := writeReply(conn, clientIP, port, reply); err != nil {
+		log.Printf("Failed to send response to %s: %v", clientIP, err)
+		return
+	}
+	if reply != nil && reply.Error != "" {
+		log.Printf("Refused client %s: %s", clientIP, reply.Error)
+		return
+	}
+	log.Printf("Client connected: %s (public port %d)", clientIP, port)
+
+	var idle <-chan time.Time
+	if hello != nil && hello.Pool && hello.PoolIdleSeconds > 0 {
+		timer := time.NewTimer(time.Duration(hello.PoolIdleSeconds) * time.Second)
+		defer timer.Stop()
+		idle = timer.C
+	}
+
+	publicConn, tunnelConn := waitForPublic(conn, sessions, expired, idle)
+	if publicConn == nil {
+		return
+	}
+	if hello != nil && hello.Pool {
+		// Warm sessions only learn about the stream now
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := writeJSONFrame(conn, &streamStart{Remote: publicConn.RemoteAddr().String()}); err != nil {
+			log.Printf("Warm session of %s is gone: %v", clientIP, err)
+			go offerPublic(publicConn, sessions)
+			return
+		}
+		conn.SetWriteDeadline(time.Time{})
+	}
+	defer publicConn.Close()
+	log.Printf("Public connection from %s forwarded to %s", publicConn.RemoteAddr(), clientIP)
+
+	if reply != nil && reply.Compression != "" {
+		tunnelConn = newCompressedConn(tunnelConn)
+	}
+	if expired != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-expired:
+				// Closing both ends stops relayTraffic
+				log.Printf("Tunnel for %s expired, closing it", clientIP)
+				conn.Close()
+				publicConn.Close()
+			case <-done:
+			}
+		}()
+	}
+	relayTraffic(tunnelConn, publicConn)
+}
+
+// waitForPublic waits until a public connection is handed to the session,
+// which returns it together with the conn to use for the tunnel side. A
+// client that goes away meanwhile is noticed, so that public connections are
+// not handed to dead sessions. Data the client sends early is kept.
+func waitForPublic(conn net.Conn, sessions chan net.Conn, expired, idle <-chan time.Time) (net.Conn, net.Conn) {
+	early := make([]byte, 1)
+	var n int
+	gone := make(chan error, 1)
+	go func() {
+		var err error
+		n, err = conn.Read(early)
+		gone <- err
+	}()
+
+	var publicConn net.Conn
+	watching := true
+wait:
+	for {
+		select {
+		case publicConn = <-sessions:
+			break wait
+		case <-expired:
+			log.Printf("Tunnel for %s expired, closing it", conn.RemoteAddr())
+			break wait
+		case <-idle:
+			// The client replaces expired warm sessions
+			break wait
+		case err := <-gone:
+			if err != nil {
+				return nil, nil
+			}
+			// Early data, keep it and wait without watching
+			watching, gone = false, nil
+		}
+	}
+
+	if watching {
+		// Stop the watcher; read timeouts leave the TLS conn usable
+		conn.SetReadDeadline(time.Unix(1, 0))
+		err := <-gone
+		conn.SetReadDeadline(time.Time{})
+		if netErr, ok := err.(net.Error); err != nil && !(ok && netErr.Timeout()) {
+			if publicConn != nil {
+				go offerPublic(publicConn, sessions)
+			}
+			return nil, nil
+		}
+	}
+	if publicConn == nil {
+		return nil, nil
+	}
+	if n > 0 {
+		return publicConn, &readerConn{Conn: conn, r: io.MultiReader(bytes.NewReader(early[:n]), conn)}
+	}
+	return publicConn, conn
+}
+
+func relayTraffic(a, b net.Conn) {
+	if _, _, err := pipeConns(a, b); err != nil {
+		log.Printf("Forwarding error: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// destRule matches a destination. host is "*", a hostname, a "*.domain"
+// wildcard, an IP or a CIDR; port 0 matches any port.
+type destRule struct {
+	host   string
+	prefix *net.IPNet
+	port   int
+}
+
+type destAllowList []destRule
+
+// parseDestAllowList parses a comma-separated list such as
+// "10.0.0.0/8,*.lan:80,db.internal:5432,[fd00::1]:22,*:443".
+func parseDestAllowList(list string) (destAllowList, error) {
+	var rules destAllowList
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		host, port := entry, 0
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			host = h
+			if p != "*" {
+				port, err = strconv.Atoi(p)
+				if err != nil || port <= 0 || port > 65535 {
+					return nil, fmt.Errorf("invalid port in allowlist entry %q", entry)
+				}
+			}
+		}
+
+		rule := destRule{host: strings.ToLower(host), port: port}
+		if strings.Contains(host, "/") {
+			_, prefix, err := net.ParseCIDR(host)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR in allowlist entry %q", entry)
+			}
+			rule.prefix = prefix
+		} else if ip := net.ParseIP(host); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			rule.prefix = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// allows reports whether host:port may be reached. ip is the resolved
+// address of host, or nil when it has not been resolved; IP and CIDR rules
+// never match an unresolved hostname.
+func (l destAllowList) allows(host string, ip net.IP, port int) bool {
+	return l.match(host, ip, port, true)
+}
+
+// allowsNamed is allows without "*" rules, for destinations that must be
+// named explicitly.
+func (l destAllowList) allowsNamed(host string, ip net.IP, port int) bool {
+	return l.match(host, ip, port, false)
+}
+
+func (l destAllowList) match(host string, ip net.IP, port int, wildcard bool) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip == nil {
+		ip = net.ParseIP(host)
+	}
+
+	for _, rule := range l {
+		if rule.port != 0 && rule.port != port {
+			continue
+		}
+		switch {
+		case rule.host == "*":
+			if wildcard {
+				return true
+			}
+		case rule.prefix != nil:
+			if ip != nil && rule.prefix.Contains(ip) {
+				return true
+			}
+		case strings.HasPrefix(rule.host, "*."):
+			if strings.HasSuffix(host, rule.host[1:]) {
+				return true
+			}
+		case rule.host == host:
+			return true
+		}
+	}
+	return false
+}
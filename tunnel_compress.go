@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Compressed streams are sent as frames of a type byte, a 4-byte length and
+// the payload. Every deflate frame is compressed on its own so that raw
+// frames can be mixed in whenever compression does not pay off.
+const (
+	compressionDeflate = "deflate"
+
+	frameRaw     = 0
+	frameDeflate = 1
+
+	maxCompressFrame = 32 * 1024
+	// A stream stops trying to compress after this many frames in a row
+	// that did not get smaller.
+	incompressibleFrames = 4
+)
+
+// compressionStats counts bytes before and after compression for one
+// direction.
+type compressionStats struct {
+	raw  atomic.Int64
+	wire atomic.Int64
+}
+
+var compressionSent, compressionReceived compressionStats
+
+// ratio returns wire bytes per raw byte, or 1 before any traffic.
+func (s *compressionStats) ratio() float64 {
+	raw := s.raw.Load()
+	if raw == 0 {
+		return 1
+	}
+	return float64(s.wire.Load()) / float64(raw)
+}
+
+// writeCompressionMetrics writes the compression counters in the
+// Prometheus text format.
+func writeCompressionMetrics(w io.Writer) {
+	stats := map[string]*compressionStats{"sent": &compressionSent, "received": &compressionReceived}
+	for _, metric := range []string{"raw", "wire"} {
+		fmt.Fprintf(w, "# TYPE ssl_tunnel_compression_%s_bytes_total counter\n", metric)
+		for _, direction := range []string{"sent", "received"} {
+			counter := &stats[direction].raw
+			if metric == "wire" {
+				counter = &stats[direction].wire
+			}
+			fmt.Fprintf(w, "ssl_tunnel_compression_%s_bytes_total{direction=%q} %d\n", metric, direction, counter.Load())
+		}
+	}
+	fmt.Fprintln(w, "# TYPE ssl_tunnel_compression_ratio gauge")
+	for _, direction := range []string{"sent", "received"} {
+		fmt.Fprintf(w, "ssl_tunnel_compression_ratio{direction=%q} %.3f\n", direction, stats[direction].ratio())
+	}
+}
+
+// negotiateCompression picks the method used by the relay from the ones a
+// client offered.
+func negotiateCompression(offered []string) string {
+	if slices.Contains(offered, compressionDeflate) {
+		return compressionDeflate
+	}
+	return ""
+}
+
+type compressedConn struct {
+	net.Conn
+
+	wmu      sync.Mutex
+	w        *flate.Writer
+	wbuf     bytes.Buffer
+	misses   int
+	disabled bool
+
+	rmu     sync.Mutex
+	r       io.ReadCloser
+	pending []byte
+}
+
+func newCompressedConn(c net.Conn) *compressedConn {
+	w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return &compressedConn{Conn: c, w: w}
+}
+
+func (c *compressedConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxCompressFrame)]
+		if err := c.writeChunk(chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *compressedConn) writeChunk(chunk []byte) error {
+	kind, payload := byte(frameRaw), chunk
+	if !c.disabled {
+		c.wbuf.Reset()
+		c.w.Reset(&c.wbuf)
+		c.w.Write(chunk)
+		c.w.Close()
+
+		if c.wbuf.Len() < len(chunk) {
+			kind, payload = frameDeflate, c.wbuf.Bytes()
+			c.misses = 0
+		} else if c.misses++; c.misses >= incompressibleFrames {
+			// Most likely TLS or already compressed media
+			log.Printf("Compression disabled for stream to %s: data is incompressible", c.RemoteAddr())
+			c.disabled = true
+		}
+	}
+
+	compressionSent.raw.Add(int64(len(chunk)))
+	compressionSent.wire.Add(int64(5 + len(payload)))
+	return writeFrame(c.Conn, []byte{kind}, payload)
+}
+
+// CloseWrite ends the stream between frames, which the peer reads as EOF.
+func (c *compressedConn) CloseWrite() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return closeWrite(c.Conn)
+}
+
+func (c *compressedConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.pending) == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *compressedConn) readFrame() error {
+	var header [5]byte
+	if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+		// A clean EOF between frames ends the stream
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxCompressFrame+1024 {
+		return fmt.Errorf("compressed frame too large (%d bytes)", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.Conn, payload); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	compressionReceived.wire.Add(int64(5 + size))
+
+	switch header[0] {
+	case frameRaw:
+		c.pending = payload
+	case frameDeflate:
+		if c.r == nil {
+			c.r = flate.NewReader(bytes.NewReader(payload))
+		} else {
+			c.r.(flate.Resetter).Reset(bytes.NewReader(payload), nil)
+		}
+		// Frames never hold more than maxCompressFrame bytes of data
+		data, err := io.ReadAll(io.LimitReader(c.r, maxCompressFrame+1))
+		if err != nil {
+			return fmt.Errorf("failed to decompress frame: %v", err)
+		}
+		if len(data) > maxCompressFrame {
+			return fmt.Errorf("compressed frame expands beyond %d bytes", maxCompressFrame)
+		}
+		c.pending = data
+	default:
+		return fmt.Errorf("invalid frame type %d", header[0])
+	}
+	compressionReceived.raw.Add(int64(len(c.pending)))
+	return nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyFromEnv returns the proxy the environment sets for addr, or nil to
+// connect directly. Like curl, $HTTPS_PROXY and $HTTP_PROXY are tried
+// before $ALL_PROXY, and $NO_PROXY and loopback addresses go direct.
+func proxyFromEnv(addr string) (*url.URL, error) {
+	value := getenvAny("HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy", "ALL_PROXY", "all_proxy")
+	if value == "" || noProxy(addr, getenvAny("NO_PROXY", "no_proxy")) {
+		return nil, nil
+	}
+	proxyURL, err := parseProxyURL(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy setting in the environment: %v", err)
+	}
+	return proxyURL, nil
+}
+
+// dialProxy connects to addr through proxyURL.
+func dialProxy(proxyURL *url.URL, addr string) (net.Conn, error) {
+	if proxyURL.Scheme == "socks5" || proxyURL.Scheme == "socks5h" {
+		return dialSOCKS5(proxyURL, addr)
+	}
+	return dialHTTPProxy(proxyURL, addr)
+}
+
+// parseProxyURL accepts http://, https://, socks5:// and socks5h:// URLs
+// with optional user:password; a bare host:port is an HTTP proxy.
+func parseProxyURL(value string) (*url.URL, error) {
+	if !strings.Contains(value, "://") {
+		value = "http://" + value
+	}
+	proxyURL, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q in %s", proxyURL.Scheme, proxyURL.Redacted())
+	}
+	if proxyURL.Hostname() == "" {
+		return nil, fmt.Errorf("proxy %s has no host", proxyURL.Redacted())
+	}
+	return proxyURL, nil
+}
+
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// noProxy reports whether addr matches the comma-separated NO_PROXY list:
+// "*", IP addresses, CIDR ranges, or domains that also match their
+// subdomains, each optionally with a :port.
+func noProxy(addr, list string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	if host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return true
+	}
+
+	for _, entry := range strings.Split(strings.ToLower(list), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "*" {
+			return true
+		}
+		if _, prefix, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && prefix.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+		if entry == "" {
+			continue
+		}
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		entry = strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialHTTPProxy opens a CONNECT tunnel to addr through an http:// or
+// https:// proxy, with basic auth from the proxy URL's user info.
+func dialHTTPProxy(proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+	conn, err := net.DialTimeout("tcp", proxyAddr, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %v", proxyAddr, err)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with proxy %s failed: %v", proxyAddr, err)
+		}
+		conn = tlsConn
+	}
+
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if user := proxyURL.User; user != nil {
+		pass, _ := user.Password()
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+pass)) + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT to proxy %s: %v", proxyAddr, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("invalid answer from proxy %s: %v", proxyAddr, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		conn.Close()
+		reason := resp.Status
+		if text := strings.TrimSpace(string(body)); text != "" {
+			reason += ": " + text
+		}
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", proxyAddr, addr, reason)
+	}
+	conn.SetDeadline(time.Time{})
+	if reader.Buffered() > 0 {
+		return &readerConn{Conn: conn, r: reader}, nil
+	}
+	return conn, nil
+}
+
+// dialSOCKS5 connects to addr through a SOCKS5 proxy, authenticating with
+// the proxy URL's user info (RFC 1929). socks5:// resolves the relay's
+// name locally, socks5h:// leaves it to the proxy.
+func dialSOCKS5(proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "1080")
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s", addr)
+	}
+
+	request := []byte{socks5Version, socks5CmdConnect, 0x00}
+	ip := net.ParseIP(host)
+	if ip == nil && proxyURL.Scheme == "socks5" {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %v", host, err)
+		}
+		ip = ips[0]
+	}
+	switch {
+	case ip.To4() != nil:
+		request = append(append(request, socks5AtypIPv4), ip.To4()...)
+	case ip != nil:
+		request = append(append(request, socks5AtypIPv6), ip.To16()...)
+	case len(host) > 255:
+		return nil, fmt.Errorf("host name %s is too long for SOCKS5", host)
+	default:
+		request = append(append(request, socks5AtypDomain, byte(len(host))), host...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+
+	conn, err := net.DialTimeout("tcp", proxyAddr, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %v", proxyAddr, err)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := socks5Handshake(conn, proxyURL.User, request); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %v", proxyAddr, addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func socks5Handshake(conn net.Conn, user *url.Userinfo, request []byte) error {
+	greeting := []byte{socks5Version, 1, socks5AuthNone}
+	if user != nil {
+		greeting = []byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	answer := make([]byte, 2)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return fmt.Errorf("no SOCKS5 greeting: %v", err)
+	}
+	if answer[0] != socks5Version {
+		return fmt.Errorf("not a SOCKS5 proxy (version %d)", answer[0])
+	}
+	switch answer[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if user == nil {
+			return fmt.Errorf("the proxy requires a username and password")
+		}
+		pass, _ := user.Password()
+		if len(user.Username()) > 255 || len(pass) > 255 {
+			return fmt.Errorf("SOCKS5 username or password longer than 255 bytes")
+		}
+		auth := append([]byte{0x01, byte(len(user.Username()))}, user.Username()...)
+		auth = append(append(auth, byte(len(pass))), pass...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, answer); err != nil {
+			return err
+		}
+		if answer[1] != 0x00 {
+			return fmt.Errorf("authentication failed for user %q", user.Username())
+		}
+	case socks5NoAcceptable:
+		if user == nil {
+			return fmt.Errorf("no acceptable authentication method (the proxy may need a username and password)")
+		}
+		return fmt.Errorf("no acceptable authentication method")
+	default:
+		return fmt.Errorf("unsupported authentication method %d", answer[1])
+	}
+
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != socks5Succeeded {
+		return fmt.Errorf("%s (SOCKS5 reply %d)", socks5ReplyText(reply[1]), reply[1])
+	}
+	// Skip the bound address
+	size := net.IPv4len
+	switch reply[3] {
+	case socks5AtypIPv6:
+		size = net.IPv6len
+	case socks5AtypDomain:
+		if _, err := io.ReadFull(conn, reply[:1]); err != nil {
+			return err
+		}
+		size = int(reply[0])
+	}
+	_, err := io.ReadFull(conn, make([]byte, size+2))
+	return err
+}
+
+func socks5ReplyText(code byte) string {
+	switch code {
+	case socks5GeneralFailure:
+		return "general SOCKS server failure"
+	case socks5NotAllowed:
+		return "connection not allowed by ruleset"
+	case 0x03:
+		return "network unreachable"
+	case socks5HostUnreachable:
+		return "host unreachable"
+	case socks5ConnectionRefused:
+		return "connection refused"
+	case 0x06:
+		return "TTL expired"
+	case socks5CmdNotSupported:
+		return "command not supported"
+	case socks5AtypNotSupported:
+		return "address type not supported"
+	default:
+		return "unknown error"
+	}
+}
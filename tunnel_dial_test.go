@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+// TestProxyFromEnv checks curl's precedence: the protocol variables before
+// ALL_PROXY, and NO_PROXY or a loopback address to go direct.
+func TestProxyFromEnv(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		addr string
+		want string
+	}{
+		{"none", nil, "relay.example.com:3742", ""},
+		{"all", map[string]string{"ALL_PROXY": "socks5://all:1080"}, "relay.example.com:3742", "socks5://all:1080"},
+		{"https before all", map[string]string{"ALL_PROXY": "socks5://all:1080", "HTTPS_PROXY": "http://https:3128"}, "relay.example.com:3742", "http://https:3128"},
+		{"http before all", map[string]string{"all_proxy": "socks5://all:1080", "http_proxy": "http://http:3128"}, "relay.example.com:3742", "http://http:3128"},
+		{"https before http", map[string]string{"HTTP_PROXY": "http://http:3128", "https_proxy": "http://https:3128"}, "relay.example.com:3742", "http://https:3128"},
+		{"no proxy", map[string]string{"HTTPS_PROXY": "http://https:3128", "NO_PROXY": ".example.com"}, "relay.example.com:3742", ""},
+		{"loopback", map[string]string{"HTTPS_PROXY": "http://https:3128"}, "127.0.0.1:3742", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, name := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy", "ALL_PROXY", "all_proxy", "NO_PROXY", "no_proxy"} {
+				t.Setenv(name, tc.env[name])
+			}
+			proxyURL, err := proxyFromEnv(tc.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if proxyURL != nil {
+				got = proxyURL.String()
+			}
+			if got != tc.want {
+				t.Errorf("proxy is %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// copyBufferSize sizes the pooled buffers used when a copy cannot splice.
+var copyBufferSize = 32 * 1024
+
+var copyBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, copyBufferSize)
+	return &buf
+}}
+
+// readerOnly and writerOnly hide ReadFrom/WriteTo so that io.CopyBuffer
+// uses the pooled buffer instead of allocating its own.
+type readerOnly struct{ io.Reader }
+type writerOnly struct{ io.Writer }
+
+// pipeConns forwards a and b in both directions until both have ended. When
+// one side stops sending, the write half of the other is shut down so that
+// its reply can still come back. It returns the bytes written to each side
+// and the first error.
+func pipeConns(a, b net.Conn) (toA, toB int64, err error) {
+	type result struct {
+		toA bool
+		n   int64
+		err error
+	}
+	results := make(chan result, 2)
+	go func() {
+		n, err := copyHalf(a, b)
+		results <- result{true, n, err}
+	}()
+	go func() {
+		n, err := copyHalf(b, a)
+		results <- result{false, n, err}
+	}()
+
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.toA {
+			toA = r.n
+		} else {
+			toB = r.n
+		}
+		if r.err != nil && err == nil {
+			// A broken direction takes the other one down with it
+			err = r.err
+			a.Close()
+			b.Close()
+		}
+	}
+	return toA, toB, err
+}
+
+// copyHalf copies src to dst until src ends, then shuts down dst's write
+// side. Between two TCP sockets this splices on Linux.
+func copyHalf(dst, src net.Conn) (int64, error) {
+	var n int64
+	var err error
+	if d, ok := dst.(*net.TCPConn); ok && isTCPConn(src) {
+		n, err = d.ReadFrom(src)
+	} else {
+		buf := copyBuffers.Get().(*[]byte)
+		n, err = io.CopyBuffer(writerOnly{dst}, readerOnly{src}, *buf)
+		copyBuffers.Put(buf)
+	}
+	closeWrite(dst)
+
+	if errors.Is(err, net.ErrClosed) {
+		// Closed on our side after the other direction ended
+		err = nil
+	}
+	return n, err
+}
+
+func isTCPConn(c net.Conn) bool {
+	_, ok := c.(*net.TCPConn)
+	return ok
+}
+
+// closeWrite shuts down the sending side of c, or all of c when it cannot
+// be half-closed. Wrapping conns implement CloseWrite with it so that the
+// half-close reaches the socket underneath.
+func closeWrite(c net.Conn) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// readerConn reads through r, which holds data already buffered from the
+// conn, e.g. by a bufio.Reader used to parse a proxy request.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *readerConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
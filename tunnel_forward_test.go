@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	tb.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		tb.Fatal("accept failed")
+	}
+	tb.Cleanup(func() {
+		dialed.Close()
+		conn.Close()
+	})
+	return dialed, conn
+}
+
+// testServerTLS returns a server config with a throwaway certificate.
+func testServerTLS(tb testing.TB) *tls.Config {
+	tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// muxStreamPair returns the two ends of a stream over a session pair.
+func muxStreamPair(tb testing.TB) (*muxStream, *muxStream) {
+	tb.Helper()
+	clientConn, relayConn := tcpPair(tb)
+	accepted := make(chan *muxStream, 1)
+	relay := newMuxSession(relayConn, false, func(st *muxStream, _ []byte) {
+		st.accept()
+		accepted <- st
+	})
+	client := newMuxSession(clientConn, true, func(st *muxStream, _ []byte) {
+		st.reject("test")
+	})
+	tb.Cleanup(func() {
+		client.Close()
+		relay.Close()
+	})
+
+	opened, err := client.open(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return opened, <-accepted
+}
+
+// BenchmarkPipeConns measures forwarding one direction between TCP
+// sockets, which splices, and from TLS to TCP, which copies through the
+// pooled buffers.
+func BenchmarkPipeConns(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		tls  bool
+	}{
+		{"TCP-TCP", false},
+		{"TLS-TCP", true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			sender, a := tcpPair(b)
+			c, receiver := tcpPair(b)
+			if bc.tls {
+				a = tls.Server(a, testServerTLS(b))
+				sender = tls.Client(sender, &tls.Config{InsecureSkipVerify: true})
+			}
+
+			piped := make(chan struct{})
+			go func() {
+				pipeConns(a, c)
+				close(piped)
+			}()
+			received := make(chan int64, 1)
+			go func() {
+				n, _ := io.Copy(io.Discard, receiver)
+				received <- n
+			}()
+
+			chunk := make([]byte, 32*1024)
+			b.SetBytes(int64(len(chunk)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := sender.Write(chunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+			closeWrite(sender)
+			n := <-received
+			b.StopTimer()
+
+			if want := int64(b.N) * int64(len(chunk)); n != want {
+				b.Fatalf("received %d bytes, want %d", n, want)
+			}
+			receiver.Close()
+			sender.Close()
+			<-piped
+		})
+	}
+}
+
+// TestHalfClose checks that after one end stops sending, the other can
+// still send its whole reply, whichever end closes first and whether the
+// path crosses a multiplexed session or not.
+func TestHalfClose(t *testing.T) {
+	request := bytes.Repeat([]byte("q"), 100*1024)
+	// Larger than a stream window, so that credit must keep flowing back
+	// after the half-close
+	reply := bytes.Repeat([]byte("r"), 4*muxWindowSize)
+
+	for _, tc := range []struct {
+		name        string
+		mux         bool
+		rightCloses bool
+	}{
+		{"tcp/left-first", false, false},
+		{"tcp/right-first", false, true},
+		{"mux/left-first", true, false},
+		{"mux/right-first", true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// left <-> pipeConns <-> [mux stream pair <-> pipeConns] <-> right
+			left, a := tcpPair(t)
+			b, right := tcpPair(t)
+			if tc.mux {
+				opened, accepted := muxStreamPair(t)
+				go pipeConns(a, opened)
+				go pipeConns(accepted, b)
+			} else {
+				go pipeConns(a, b)
+			}
+
+			first, second := left, right
+			if tc.rightCloses {
+				first, second = right, left
+			}
+			deadline := time.Now().Add(10 * time.Second)
+			first.SetDeadline(deadline)
+			second.SetDeadline(deadline)
+
+			errs := make(chan error, 1)
+			go func() {
+				got, err := io.ReadAll(second)
+				if err == nil && !bytes.Equal(got, request) {
+					err = io.ErrUnexpectedEOF
+				}
+				if err == nil {
+					_, err = second.Write(reply)
+				}
+				closeWrite(second)
+				errs <- err
+			}()
+
+			if _, err := first.Write(request); err != nil {
+				t.Fatal(err)
+			}
+			if err := closeWrite(first); err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(first)
+			if err != nil {
+				t.Fatalf("reading reply: %v", err)
+			}
+			if err := <-errs; err != nil {
+				t.Fatalf("other end: %v", err)
+			}
+			if len(got) != len(reply) {
+				t.Fatalf("got %d bytes of reply, want %d", len(got), len(reply))
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// The original handshake is a fixed 10-byte key answered by 20 bytes
+// (16 bytes of client IP, 4 bytes of tunnel port). An extended hello sets
+// the last key byte to helloExtended and follows the key with a
+// length-prefixed JSON tunnelHello; the relay then follows its 20-byte
+// answer with a length-prefixed JSON tunnelReply.
+var tunnelKey = []byte{0x00, 0x08, 0x00, 0x00, 0x00, 0x22, 0x4D, 0x00, 0x00, 0x00}
+
+const (
+	helloExtended = 0x01
+	maxHelloSize  = 64 * 1024
+)
+
+type tunnelHello struct {
+	// Connect asks the relay to dial host:port on its own network.
+	Connect string `json:"connect,omitempty"`
+	// Egress offers this session to the relay's proxy service; the relay
+	// later sends an egressCommand on it.
+	Egress bool `json:"egress,omitempty"`
+	// StartedTime and TotalMinutes limit how long the relay keeps the
+	// public side open, as in ClientRelayPort.
+	StartedTime  time.Time `json:"StartedTime,omitzero"`
+	TotalMinutes *int      `json:"TotalMinutes,omitempty"`
+	// Compression lists the stream compression methods the client supports.
+	Compression []string `json:"compression,omitempty"`
+	// Pool marks a warm session: the relay keeps it idle for up to
+	// PoolIdleSeconds and sends a streamStart frame when it hands the
+	// session a public connection.
+	Pool            bool `json:"pool,omitempty"`
+	PoolIdleSeconds int  `json:"poolIdleSeconds,omitempty"`
+	// Hostname registers the session for TLS connections with this server
+	// name (or "*.domain") on the relay's SNI listener.
+	Hostname string `json:"hostname,omitempty"`
+	// Terminate has the relay complete TLS for Hostname with its own
+	// certificate, so that sessions carry the decrypted stream.
+	Terminate bool `json:"terminate,omitempty"`
+	// Port asks for this public port on relays that allocate ports per
+	// client; the port granted is in the 20-byte answer as before.
+	Port int `json:"port,omitempty"`
+	// Mux turns the session into a multiplexed one (see tunnel_mux.go).
+	// Remote lists the public ports of its remote forwards, 0 for any;
+	// local forwards open streams with a muxRequest Connect.
+	Mux    bool  `json:"mux,omitempty"`
+	Remote []int `json:"remote,omitempty"`
+	// P2P offers direct connections to other clients of the relay; it
+	// lists the client's own addresses for them, the relay adds the one it
+	// observes.
+	P2P []string `json:"p2p,omitempty"`
+}
+
+type tunnelReply struct {
+	Error string `json:"error,omitempty"`
+	// Code is a short machine-readable reason: "denied", "refused",
+	// "unreachable" or "failed".
+	Code string `json:"code,omitempty"`
+	// Compression is the method picked from the hello; the stream after
+	// the reply is framed by compressedConn when it is set.
+	Compression string `json:"compression,omitempty"`
+	// Ports are the public ports granted to the remote forwards, in the
+	// order of the hello.
+	Ports []int `json:"ports,omitempty"`
+}
+
+// streamStart tells a warm session that a public connection was handed to
+// it and where that connection came from.
+type streamStart struct {
+	Remote string `json:"remote"`
+}
+
+const egressConnect = 1
+
+// egressCommand mirrors Models/RotatingSocketModel. The relay sends it on an
+// idle egress session to have the client dial Host:Port, and the client
+// answers with a tunnelReply frame.
+type egressCommand struct {
+	SessionId string
+	Host      string
+	Port      int
+	Ip        string
+	Command   int
+}
+
+func writeHello(w io.Writer, hello *tunnelHello) error {
+	key := append([]byte(nil), tunnelKey...)
+	key[len(key)-1] = helloExtended
+	payload, err := json.Marshal(hello)
+	if err != nil {
+		return err
+	}
+	return writeFrame(w, key, payload)
+}
+
+// readHello returns a nil hello for clients using the original handshake.
+func readHello(r io.Reader) (*tunnelHello, error) {
+	key := make([]byte, len(tunnelKey))
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, fmt.Errorf("failed to read key: %v", err)
+	}
+	last := len(key) - 1
+	if !bytes.Equal(key[:last], tunnelKey[:last]) {
+		return nil, fmt.Errorf("invalid key %x", key)
+	}
+
+	switch key[last] {
+	case tunnelKey[last]:
+		return nil, nil
+	case helloExtended:
+		hello := &tunnelHello{}
+		if err := readJSONFrame(r, hello); err != nil {
+			return nil, fmt.Errorf("failed to read hello: %v", err)
+		}
+		return hello, nil
+	default:
+		return nil, fmt.Errorf("invalid key %x", key)
+	}
+}
+
+// writeReply sends the 20-byte answer, followed by the JSON reply when the
+// client used an extended hello.
+func writeReply(w io.Writer, clientIP net.IP, port int, reply *tunnelReply) error {
+	response := make([]byte, 20)
+	if ip4 := clientIP.To4(); ip4 != nil {
+		copy(response, ip4)
+	} else {
+		copy(response, clientIP.To16())
+	}
+	binary.BigEndian.PutUint32(response[16:20], uint32(port))
+
+	if reply == nil {
+		_, err := w.Write(response)
+		return err
+	}
+	payload, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	return writeFrame(w, response, payload)
+}
+
+func readReply(r io.Reader) (int, *tunnelReply, error) {
+	response := make([]byte, 20)
+	if _, err := io.ReadFull(r, response); err != nil {
+		return 0, nil, fmt.Errorf("failed to receive response from server: %v", err)
+	}
+	reply := &tunnelReply{}
+	if err := readJSONFrame(r, reply); err != nil {
+		return 0, nil, fmt.Errorf("failed to read reply: %v", err)
+	}
+	return int(binary.BigEndian.Uint32(response[16:20])), reply, nil
+}
+
+func writeJSONFrame(w io.Writer, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFrame(w, nil, payload)
+}
+
+func writeFrame(w io.Writer, prefix, payload []byte) error {
+	buf := make([]byte, 0, len(prefix)+4+len(payload))
+	buf = append(buf, prefix...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = append(buf, payload...)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readJSONFrame(r io.Reader, v interface{}) error {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	if size > maxHelloSize {
+		return fmt.Errorf("frame too large (%d bytes)", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, v)
+}
+
+// certThumbprint is the uppercase hex SHA-1 of a DER certificate, the form
+// the C# relay and -allow-thumbprint use.
+func certThumbprint(raw []byte) string {
+	sum := sha1.Sum(raw)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
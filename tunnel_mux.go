@@ -0,0 +1,524 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// A multiplexed session carries many streams over one tunnel connection.
+// Frames are a type byte, a 4-byte stream ID and a 4-byte length, followed
+// by the payload. The client opens odd stream IDs and the relay even ones.
+// Each side may have muxWindowSize bytes in flight per stream; the reader
+// returns credit with muxWindow frames as the data is consumed, so that a
+// slow stream never stalls the others.
+const (
+	muxOpen     = 1 // payload is a JSON muxRequest
+	muxOpenOK   = 2
+	muxOpenFail = 3 // payload is the reason
+	muxData     = 4
+	muxFin      = 5 // the sender will send no more data on the stream
+	muxReset    = 6 // the stream is aborted in both directions
+	muxWindow   = 7 // payload is the 4-byte credit returned
+	muxPing     = 8
+)
+
+const (
+	muxHeaderSize   = 9
+	muxMaxFrame     = 32 * 1024
+	muxWindowSize   = 256 * 1024
+	muxPingInterval = 30 * time.Second
+	muxIdleTimeout  = 90 * time.Second
+	muxOpenTimeout  = 30 * time.Second
+)
+
+var (
+	errMuxClosed   = errors.New("multiplexed session closed")
+	errStreamReset = errors.New("stream reset by peer")
+)
+
+// muxRequest is the payload of muxOpen.
+type muxRequest struct {
+	// Forward is the index of the client's remote forward a public
+	// connection arrived on.
+	Forward int `json:"forward,omitempty"`
+	// Remote is the address the public connection came from.
+	Remote string `json:"remote,omitempty"`
+	// Connect asks the relay to dial host:port on its network.
+	Connect string `json:"connect,omitempty"`
+	// Rendezvous asks the relay for a direct path to the client serving
+	// host:port; the relay answers with a peerOffer frame on the stream.
+	Rendezvous string `json:"rendezvous,omitempty"`
+	// Peer tells the client serving Forward that a peer will connect.
+	Peer *peerOffer `json:"peer,omitempty"`
+}
+
+// peerOffer introduces two clients to each other. Both try to connect to
+// the other's candidates at once, send Token first on the connection and
+// then run TLS, where Dial is the TLS client and both check that the other
+// presents the certificate with Thumbprint.
+type peerOffer struct {
+	Token      string   `json:"token"`
+	Thumbprint string   `json:"thumbprint"`
+	Candidates []string `json:"candidates"`
+	Forward    int      `json:"forward"`
+	Dial       bool     `json:"dial,omitempty"`
+}
+
+type muxSession struct {
+	conn   net.Conn
+	onOpen func(*muxStream, []byte)
+
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	err     error
+	done    chan struct{}
+}
+
+// newMuxSession starts reading frames from conn. onOpen runs in its own
+// goroutine for each stream the peer opens and must accept or reject it.
+func newMuxSession(conn net.Conn, client bool, onOpen func(*muxStream, []byte)) *muxSession {
+	s := &muxSession{conn: conn, onOpen: onOpen, streams: make(map[uint32]*muxStream), nextID: 2, done: make(chan struct{})}
+	if client {
+		s.nextID = 1
+	}
+	go s.readLoop()
+	go s.pingLoop()
+	return s
+}
+
+func (s *muxSession) writeFrame(typ byte, id uint32, payload []byte) error {
+	buf := make([]byte, muxHeaderSize, muxHeaderSize+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:5], id)
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(payload)))
+	buf = append(buf, payload...)
+
+	s.wmu.Lock()
+	_, err := s.conn.Write(buf)
+	s.wmu.Unlock()
+	if err != nil {
+		s.fail(err)
+		return errMuxClosed
+	}
+	return nil
+}
+
+func (s *muxSession) readLoop() {
+	header := make([]byte, muxHeaderSize)
+	for {
+		// Pings keep an idle session within the timeout
+		s.conn.SetReadDeadline(time.Now().Add(muxIdleTimeout))
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			s.fail(err)
+			return
+		}
+		typ, id, size := header[0], binary.BigEndian.Uint32(header[1:5]), binary.BigEndian.Uint32(header[5:9])
+		if size > muxMaxFrame {
+			s.fail(fmt.Errorf("frame too large (%d bytes)", size))
+			return
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.fail(err)
+			return
+		}
+
+		if typ == muxPing {
+			continue
+		}
+		if typ == muxOpen {
+			if st := s.accept(id); st != nil {
+				go s.onOpen(st, payload)
+			} else {
+				s.fail(fmt.Errorf("invalid stream ID %d opened", id))
+				return
+			}
+			continue
+		}
+
+		s.mu.Lock()
+		st := s.streams[id]
+		s.mu.Unlock()
+		if st == nil {
+			// Frames still in flight for a stream closed here
+			continue
+		}
+		switch typ {
+		case muxOpenOK, muxOpenFail:
+			var err error
+			if typ == muxOpenFail {
+				err = errors.New(string(payload))
+			}
+			select {
+			case st.opened <- err:
+			default:
+			}
+		case muxData:
+			if !st.push(payload) {
+				s.fail(fmt.Errorf("stream %d exceeded its window", id))
+				return
+			}
+		case muxFin:
+			st.finish(nil)
+		case muxReset:
+			st.finish(errStreamReset)
+			s.remove(id)
+		case muxWindow:
+			if len(payload) == 4 {
+				st.addCredit(int(binary.BigEndian.Uint32(payload)))
+			}
+		default:
+			s.fail(fmt.Errorf("invalid frame type %d", typ))
+			return
+		}
+	}
+}
+
+func (s *muxSession) pingLoop() {
+	ticker := time.NewTicker(muxPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.writeFrame(muxPing, 0, nil)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// fail closes the session and resets its streams; the first error is kept.
+func (s *muxSession) fail(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*muxStream)
+	s.mu.Unlock()
+
+	close(s.done)
+	s.conn.Close()
+	for _, st := range streams {
+		st.finish(errMuxClosed)
+	}
+}
+
+func (s *muxSession) Close() error {
+	s.fail(errMuxClosed)
+	return nil
+}
+
+// Err returns why the session ended, once done is closed.
+func (s *muxSession) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *muxSession) newStream(id uint32) *muxStream {
+	return &muxStream{
+		s:        s,
+		id:       id,
+		opened:   make(chan error, 1),
+		credit:   muxWindowSize,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+// accept registers a stream opened by the peer, which must use the peer's
+// ID parity and a new ID.
+func (s *muxSession) accept(id uint32) *muxStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil || id%2 == s.nextID%2 || s.streams[id] != nil {
+		return nil
+	}
+	st := s.newStream(id)
+	s.streams[id] = st
+	return st
+}
+
+func (s *muxSession) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// open starts a stream and waits until the peer accepts or rejects it.
+func (s *muxSession) open(req []byte) (*muxStream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, errMuxClosed
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := s.newStream(id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(muxOpen, id, req); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(muxOpenTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-st.opened:
+		if err != nil {
+			s.remove(id)
+			return nil, err
+		}
+		return st, nil
+	case <-timer.C:
+		st.Close()
+		return nil, fmt.Errorf("no answer to stream open within %s", muxOpenTimeout)
+	case <-s.done:
+		return nil, errMuxClosed
+	}
+}
+
+// muxStream is one stream of a session. It is a net.Conn whose CloseWrite
+// sends a muxFin, so that pipeConns half-closes through the session.
+type muxStream struct {
+	s      *muxSession
+	id     uint32
+	opened chan error
+	remote net.Addr
+
+	mu            sync.Mutex
+	buf           []byte
+	unacked       int
+	credit        int
+	recvFin       bool
+	sentFin       bool
+	closed        bool
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readable      chan struct{}
+	writable      chan struct{}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push queues data from the peer; it fails if the peer ignored the window.
+func (st *muxStream) push(data []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed || st.err != nil {
+		return true
+	}
+	if len(st.buf)+st.unacked+len(data) > muxWindowSize {
+		return false
+	}
+	st.buf = append(st.buf, data...)
+	notify(st.readable)
+	return true
+}
+
+// finish marks the end of the peer's data, or of the stream when err is set.
+func (st *muxStream) finish(err error) {
+	st.mu.Lock()
+	if err != nil {
+		if st.err == nil {
+			st.err = err
+		}
+	} else {
+		st.recvFin = true
+	}
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+}
+
+func (st *muxStream) addCredit(n int) {
+	st.mu.Lock()
+	st.credit += n
+	st.mu.Unlock()
+	notify(st.writable)
+}
+
+// waitNotify blocks until ch is signalled or the deadline passes.
+func waitNotify(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (st *muxStream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if len(st.buf) > 0 {
+			n := copy(p, st.buf)
+			st.buf = st.buf[n:]
+			if len(st.buf) == 0 {
+				st.buf = nil
+			}
+			st.unacked += n
+			ack := 0
+			if st.unacked >= muxWindowSize/2 {
+				ack, st.unacked = st.unacked, 0
+			}
+			st.mu.Unlock()
+			if ack > 0 {
+				st.s.writeFrame(muxWindow, st.id, binary.BigEndian.AppendUint32(nil, uint32(ack)))
+			}
+			return n, nil
+		}
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return 0, net.ErrClosed
+		case st.recvFin:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+			return 0, err
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+		if err := waitNotify(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		switch {
+		case st.closed || st.sentFin:
+			st.mu.Unlock()
+			return written, net.ErrClosed
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+			return written, err
+		case st.credit == 0:
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := waitNotify(st.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(len(p), st.credit, muxMaxFrame)
+		st.credit -= n
+		st.mu.Unlock()
+
+		if err := st.s.writeFrame(muxData, st.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite tells the peer that no more data follows.
+func (st *muxStream) CloseWrite() error {
+	st.mu.Lock()
+	if st.closed || st.sentFin || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.sentFin = true
+	st.mu.Unlock()
+	return st.s.writeFrame(muxFin, st.id, nil)
+}
+
+// Close ends the stream. It is reset unless both sides already finished
+// sending, like a TCP close with data still unread.
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	reset := st.err == nil && !(st.sentFin && st.recvFin)
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+
+	st.s.remove(st.id)
+	if reset {
+		return st.s.writeFrame(muxReset, st.id, nil)
+	}
+	return nil
+}
+
+// accept answers a stream opened by the peer.
+func (st *muxStream) accept() error {
+	return st.s.writeFrame(muxOpenOK, st.id, nil)
+}
+
+func (st *muxStream) reject(reason string) {
+	st.s.remove(st.id)
+	st.s.writeFrame(muxOpenFail, st.id, []byte(reason))
+}
+
+func (st *muxStream) LocalAddr() net.Addr { return st.s.conn.LocalAddr() }
+
+func (st *muxStream) RemoteAddr() net.Addr {
+	if st.remote != nil {
+		return st.remote
+	}
+	return st.s.conn.RemoteAddr()
+}
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+// Deadline changes wake up a blocked Read or Write to pick them up.
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readable)
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writable)
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	socks5Version      = 0x05
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5NoAcceptable = 0xFF
+	socks5CmdConnect   = 0x01
+	socks5AtypIPv4     = 0x01
+	socks5AtypDomain   = 0x03
+	socks5AtypIPv6     = 0x04
+
+	socks5Succeeded         = 0x00
+	socks5GeneralFailure    = 0x01
+	socks5NotAllowed        = 0x02
+	socks5HostUnreachable   = 0x04
+	socks5ConnectionRefused = 0x05
+	socks5CmdNotSupported   = 0x07
+	socks5AtypNotSupported  = 0x08
+)
+
+// readSOCKS5Request runs the SOCKS5 greeting, the optional RFC 1929
+// username/password sub-negotiation (when auth is non-nil) and reads a
+// CONNECT request. On error the client has already been answered.
+func readSOCKS5Request(conn net.Conn, reader *bufio.Reader, auth func(user, pass string) bool) (string, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", "", err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", "", err
+	}
+
+	method := byte(socks5AuthNone)
+	if auth != nil {
+		method = socks5AuthPassword
+	}
+	if !strings.ContainsRune(string(methods), rune(method)) {
+		conn.Write([]byte{socks5Version, socks5NoAcceptable})
+		return "", "", fmt.Errorf("no acceptable authentication method")
+	}
+	conn.Write([]byte{socks5Version, method})
+
+	var user string
+	if auth != nil {
+		var pass string
+		var err error
+		user, pass, err = readSOCKS5Credentials(reader)
+		if err != nil {
+			return "", "", err
+		}
+		if !auth(user, pass) {
+			conn.Write([]byte{0x01, 0x01})
+			return "", user, fmt.Errorf("authentication failed for user %q", user)
+		}
+		conn.Write([]byte{0x01, 0x00})
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return "", user, err
+	}
+	if request[0] != socks5Version {
+		return "", user, fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+
+	var host string
+	switch request[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		size := net.IPv4len
+		if request[3] == socks5AtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", user, err
+		}
+		host = net.IP(ip).String()
+	case socks5AtypDomain:
+		size, err := reader.ReadByte()
+		if err != nil {
+			return "", user, err
+		}
+		name := make([]byte, size)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return "", user, err
+		}
+		host = string(name)
+	default:
+		writeSOCKS5Reply(conn, socks5AtypNotSupported)
+		return "", user, fmt.Errorf("unsupported address type %d", request[3])
+	}
+
+	var port uint16
+	if err := binary.Read(reader, binary.BigEndian, &port); err != nil {
+		return "", user, err
+	}
+
+	if request[1] != socks5CmdConnect {
+		writeSOCKS5Reply(conn, socks5CmdNotSupported)
+		return "", user, fmt.Errorf("unsupported command %d", request[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), user, nil
+}
+
+func readSOCKS5Credentials(reader *bufio.Reader) (string, string, error) {
+	version, err := reader.ReadByte()
+	if err != nil {
+		return "", "", err
+	}
+	if version != 0x01 {
+		return "", "", fmt.Errorf("unsupported auth version %d", version)
+	}
+
+	var fields [2]string
+	for i := range fields {
+		size, err := reader.ReadByte()
+		if err != nil {
+			return "", "", err
+		}
+		value := make([]byte, size)
+		if _, err := io.ReadFull(reader, value); err != nil {
+			return "", "", err
+		}
+		fields[i] = string(value)
+	}
+	return fields[0], fields[1], nil
+}
+
+func writeSOCKS5Reply(conn net.Conn, code byte) {
+	conn.Write([]byte{socks5Version, code, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+}
+
+func socks5ReplyCode(code string) byte {
+	switch code {
+	case "denied":
+		return socks5NotAllowed
+	case "refused":
+		return socks5ConnectionRefused
+	case "unreachable":
+		return socks5HostUnreachable
+	default:
+		return socks5GeneralFailure
+	}
+}
+
+func parseProxyAuthorization(req *http.Request) (string, string) {
+	auth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return "", ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len("Basic "):])
+	if err != nil {
+		return "", ""
+	}
+	user, pass, _ := strings.Cut(string(decoded), ":")
+	return user, pass
+}
+
+func writeProxyAuthRequired(conn net.Conn) {
+	io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"tunlify\"\r\nContent-Length: 0\r\n\r\n")
+}
+
+func proxyStreams(localConn net.Conn, reader io.Reader, stream net.Conn) {
+	pipeConns(&readerConn{Conn: localConn, r: reader}, stream)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// httpRewrite holds the rewrite rules of an HTTP tunnel. Requests are
+// mapped from the public side to the target, and Location and Set-Cookie
+// in responses are mapped back, so that redirects and cookies of the
+// target keep working under the public name and path.
+type httpRewrite struct {
+	// Path is the public path prefix the tunnel is exposed under, like
+	// ClientRelayPort.Path. Requests outside it get a 404; it is stripped
+	// before the request goes to the target.
+	Path string `json:"path,omitempty"`
+	// AddPrefix is put in front of the path sent to the target, for
+	// targets that live below a path of their own.
+	AddPrefix string `json:"addPrefix,omitempty"`
+	// Host is the Host header sent to the target: "target" for the
+	// target's address, or a name of its own. Empty keeps the public Host.
+	Host string `json:"host,omitempty"`
+	// CookieDomain replaces the Domain of cookies set for the target's
+	// name (default the public host name).
+	CookieDomain string `json:"cookieDomain,omitempty"`
+
+	RequestHeaders  headerRules `json:"requestHeaders"`
+	ResponseHeaders headerRules `json:"responseHeaders"`
+}
+
+// headerRules are applied in the order remove, set, add.
+type headerRules struct {
+	Remove []string          `json:"remove,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+}
+
+func (r *headerRules) apply(h http.Header) {
+	for _, name := range r.Remove {
+		h.Del(name)
+	}
+	for name, value := range r.Set {
+		h.Set(name, value)
+	}
+	for name, value := range r.Add {
+		h.Add(name, value)
+	}
+}
+
+func loadRewrite(path string) (*httpRewrite, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rewrite config: %v", err)
+	}
+	var rw httpRewrite
+	if err := json.Unmarshal(data, &rw); err != nil {
+		return nil, fmt.Errorf("failed to parse rewrite config: %v", err)
+	}
+	if err := rw.check(); err != nil {
+		return nil, fmt.Errorf("invalid rewrite config %s: %v", path, err)
+	}
+	return &rw, nil
+}
+
+func (rw *httpRewrite) check() error {
+	for _, prefix := range []string{rw.Path, rw.AddPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("path prefix %q must start with /", prefix)
+		}
+	}
+	return nil
+}
+
+// rewriteScope remembers how a request was mapped, for its response.
+type rewriteScope struct {
+	rw           *httpRewrite
+	publicHost   string
+	publicScheme string
+	targetHosts  []string
+}
+
+// rewriteRequest maps req, about to be sent to target (host:port), and
+// returns the scope for its response. ok is false when the request is
+// outside the public path.
+func (rw *httpRewrite) rewriteRequest(req *http.Request, target string) (*rewriteScope, bool) {
+	scope := &rewriteScope{rw: rw, publicHost: req.Host, publicScheme: req.Header.Get("X-Forwarded-Proto")}
+	path, ok := stripPathPrefix(req.URL.Path, rw.Path)
+	if !ok {
+		return scope, false
+	}
+	req.URL.Path = joinPathPrefix(rw.AddPrefix, path)
+	req.URL.RawPath = ""
+
+	switch rw.Host {
+	case "":
+	case "target":
+		req.Host = target
+	default:
+		req.Host = rw.Host
+	}
+	scope.targetHosts = []string{hostName(target), hostName(req.Host)}
+	rw.RequestHeaders.apply(req.Header)
+	return scope, true
+}
+
+// rewriteResponse maps Location and Set-Cookie back to the public side and
+// applies the response header rules.
+func (sc *rewriteScope) rewriteResponse(resp *http.Response) {
+	if location := resp.Header.Get("Location"); location != "" {
+		resp.Header.Set("Location", sc.location(location))
+	}
+	if cookies := resp.Header.Values("Set-Cookie"); len(cookies) > 0 {
+		rewritten := make([]string, len(cookies))
+		for i, cookie := range cookies {
+			rewritten[i] = sc.cookie(cookie)
+		}
+		resp.Header["Set-Cookie"] = rewritten
+	}
+	sc.rw.ResponseHeaders.apply(resp.Header)
+}
+
+// isTarget reports whether host names the target. Local targets often
+// call themselves localhost whatever address they are reached on.
+func (sc *rewriteScope) isTarget(host string) bool {
+	name := hostName(host)
+	for _, target := range sc.targetHosts {
+		if strings.EqualFold(name, target) || (isLoopbackName(name) && isLoopbackName(target)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isLoopbackName(name string) bool {
+	ip := net.ParseIP(name)
+	return strings.EqualFold(name, "localhost") || (ip != nil && ip.IsLoopback())
+}
+
+// publicPath maps a path of the target to the public one; paths outside
+// AddPrefix cannot be reached through the tunnel and stay as they are.
+func (sc *rewriteScope) publicPath(path string) string {
+	stripped, ok := stripPathPrefix(path, sc.rw.AddPrefix)
+	if !ok {
+		return path
+	}
+	if stripped == "/" && !strings.HasSuffix(path, "/") {
+		// The prefix itself, e.g. a cookie for all of the target
+		if public := strings.TrimSuffix(sc.rw.Path, "/"); public != "" {
+			return public
+		}
+	}
+	return joinPathPrefix(sc.rw.Path, stripped)
+}
+
+// location rewrites absolute redirects to the target to the public host,
+// and the paths of both absolute and host-relative ones.
+func (sc *rewriteScope) location(location string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	switch {
+	case u.Host != "":
+		if !sc.isTarget(u.Host) {
+			return location
+		}
+		u.Host = sc.publicHost
+		if sc.publicScheme != "" {
+			u.Scheme = sc.publicScheme
+		}
+	case !strings.HasPrefix(u.Path, "/"):
+		// Relative to the current path, which already is the public one
+		return location
+	}
+	u.Path = sc.publicPath(u.Path)
+	u.RawPath = ""
+	return u.String()
+}
+
+// cookie rewrites the Domain and Path attributes of a Set-Cookie value and
+// leaves everything else as it is.
+func (sc *rewriteScope) cookie(value string) string {
+	parts := strings.Split(value, ";")
+	for i, part := range parts[1:] {
+		name, attr, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch strings.ToLower(name) {
+		case "domain":
+			if !sc.isTarget(strings.TrimPrefix(attr, ".")) {
+				continue
+			}
+			domain := sc.rw.CookieDomain
+			if domain == "" {
+				domain = hostName(sc.publicHost)
+			}
+			parts[i+1] = " Domain=" + domain
+		case "path":
+			if strings.HasPrefix(attr, "/") {
+				parts[i+1] = " Path=" + sc.publicPath(attr)
+			}
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// stripPathPrefix removes prefix from path at a segment boundary.
+func stripPathPrefix(path, prefix string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return path, true
+	}
+	if path == prefix {
+		return "/", true
+	}
+	if !strings.HasPrefix(path, prefix+"/") {
+		return path, false
+	}
+	return path[len(prefix):], true
+}
+
+func joinPathPrefix(prefix, path string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return prefix + path
+}
+
+func hostName(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		return name
+	}
+	return strings.Trim(host, "[]")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// httpRoute sends the requests it matches to Target. Exactly one of
+// Exact, Prefix and Regex is set.
+type httpRoute struct {
+	Exact  string `json:"exact,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	Regex  string `json:"regex,omitempty"`
+	// Target is the host:port of the local HTTP service.
+	Target string `json:"target"`
+	// Strip removes the matched path (for Regex the part matched at the
+	// start, which must end at a path segment boundary) before the request
+	// goes to Target, and adds it back to Location and Set-Cookie paths.
+	Strip bool `json:"strip,omitempty"`
+	// Rewrite holds further rules for this route.
+	Rewrite *httpRewrite `json:"rewrite,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// routeTable picks the route of a request: an exact match first, then the
+// first matching regex in file order, then the longest prefix.
+type routeTable struct {
+	exact  []*httpRoute
+	regex  []*httpRoute
+	prefix []*httpRoute
+}
+
+func loadRoutes(path string) (*routeTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routes: %v", err)
+	}
+	var routes []*httpRoute
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("failed to parse routes: %v", err)
+	}
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("routes file %s has no routes", path)
+	}
+
+	table := &routeTable{}
+	for i, route := range routes {
+		if err := route.check(); err != nil {
+			return nil, fmt.Errorf("route %d in %s: %v", i+1, path, err)
+		}
+		switch {
+		case route.Exact != "":
+			table.exact = append(table.exact, route)
+		case route.Regex != "":
+			table.regex = append(table.regex, route)
+		default:
+			table.prefix = append(table.prefix, route)
+		}
+	}
+	sort.SliceStable(table.prefix, func(i, j int) bool {
+		return len(strings.TrimSuffix(table.prefix[i].Prefix, "/")) > len(strings.TrimSuffix(table.prefix[j].Prefix, "/"))
+	})
+	return table, nil
+}
+
+func (r *httpRoute) check() error {
+	set := 0
+	for _, match := range []string{r.Exact, r.Prefix, r.Regex} {
+		if match != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("needs exactly one of exact, prefix and regex")
+	}
+	if r.Exact != "" && !strings.HasPrefix(r.Exact, "/") || r.Prefix != "" && !strings.HasPrefix(r.Prefix, "/") {
+		return fmt.Errorf("paths must start with /")
+	}
+	if r.Regex != "" {
+		var err error
+		if r.re, err = regexp.Compile(r.Regex); err != nil {
+			return fmt.Errorf("invalid regex: %v", err)
+		}
+	}
+	if _, _, err := net.SplitHostPort(r.Target); err != nil {
+		return fmt.Errorf("invalid target %q, expected host:port", r.Target)
+	}
+	if r.Rewrite != nil {
+		return r.Rewrite.check()
+	}
+	return nil
+}
+
+// match returns the route for path and the part of path it matched, or
+// nil when no route applies. A regex route with strip whose match at the
+// start ends inside a path segment does not apply, as a prefix would not.
+func (t *routeTable) match(path string) (*httpRoute, string) {
+	for _, route := range t.exact {
+		if path == route.Exact {
+			return route, path
+		}
+	}
+	for _, route := range t.regex {
+		loc := route.re.FindStringIndex(path)
+		switch {
+		case loc == nil:
+		case loc[0] != 0:
+			return route, ""
+		case !route.Strip || loc[1] == len(path) || path[loc[1]] == '/' || strings.HasSuffix(path[:loc[1]], "/"):
+			return route, path[:loc[1]]
+		}
+	}
+	for _, route := range t.prefix {
+		if _, ok := stripPathPrefix(path, route.Prefix); ok {
+			return route, strings.TrimSuffix(route.Prefix, "/")
+		}
+	}
+	return nil, ""
+}
+
+// rewriteFor returns the rewrite rules of a request the route matched, or
+// nil when it has none.
+func (r *httpRoute) rewriteFor(matched string) *httpRewrite {
+	if !r.Strip || strings.TrimSuffix(matched, "/") == "" {
+		return r.Rewrite
+	}
+	rw := httpRewrite{}
+	if r.Rewrite != nil {
+		rw = *r.Rewrite
+	}
+	rw.Path = strings.TrimSuffix(matched, "/")
+	return &rw
+}
+
+// gRPC needs HTTP/2, which a local server without TLS only speaks as h2c;
+// other requests use HTTP/1.1.
+func newH2CTransport() *http.Transport {
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return transport
+}
+
+func isGRPC(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
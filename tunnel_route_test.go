@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeHostRoutes starts a local server answering with the Host it got and
+// writes a routes file sending /public to it as is and /target with the
+// target's address.
+func writeHostRoutes(t *testing.T) (string, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	})}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	target := listener.Addr().String()
+
+	path := filepath.Join(t.TempDir(), "routes.json")
+	routes := `[{"prefix": "/public", "target": "` + target + `"},
+		{"prefix": "/target", "target": "` + target + `", "rewrite": {"host": "target"}}]`
+	if err := os.WriteFile(path, []byte(routes), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, target
+}
+
+// getHost requests path from addr as public.example.com and returns the
+// Host the local server saw.
+func getHost(t *testing.T, addr, path string) string {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addr+path, nil)
+	req.Host = "public.example.com"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	host, _ := io.ReadAll(resp.Body)
+	return strings.TrimSpace(string(host))
+}
+
+// TestRouteMatch checks route precedence (exact, then regex in file order,
+// then the longest prefix) and the path each route passes on with strip.
+func TestRouteMatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	routes := `[{"prefix": "/", "target": "root:80"},
+		{"prefix": "/api", "target": "api:80", "strip": true},
+		{"prefix": "/api/v2/", "target": "v2:80"},
+		{"exact": "/api/health", "target": "health:80", "strip": true},
+		{"exact": "/status", "target": "status:80"},
+		{"regex": "^/static", "target": "static:80", "strip": true},
+		{"regex": "^/u/[0-9]+/", "target": "user:80", "strip": true},
+		{"regex": "\\.php$", "target": "php:80", "strip": true},
+		{"regex": "^/api/ws", "target": "ws:80"}]`
+	if err := os.WriteFile(path, []byte(routes), 0644); err != nil {
+		t.Fatal(err)
+	}
+	table, err := loadRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path   string
+		target string
+		sent   string
+	}{
+		{"/status", "status:80", "/status"},
+		{"/status/x", "root:80", "/status/x"},
+		{"/api/health", "health:80", "/"},
+		{"/api/ws/chat", "ws:80", "/api/ws/chat"},
+		{"/api/wsx", "ws:80", "/api/wsx"},
+		{"/api/users", "api:80", "/users"},
+		{"/api", "api:80", "/"},
+		{"/apix", "root:80", "/apix"},
+		{"/api/v2/items", "v2:80", "/api/v2/items"},
+		{"/static", "static:80", "/"},
+		{"/static/a.css", "static:80", "/a.css"},
+		{"/staticfiles/a.css", "root:80", "/staticfiles/a.css"},
+		{"/u/42/profile", "user:80", "/profile"},
+		{"/u/42x/profile", "root:80", "/u/42x/profile"},
+		{"/cgi/index.php", "php:80", "/cgi/index.php"},
+	} {
+		route, matched := table.match(tc.path)
+		if route == nil || route.Target != tc.target {
+			t.Errorf("%s: routed to %v, want %s", tc.path, route, tc.target)
+			continue
+		}
+		req, _ := http.NewRequest(http.MethodGet, "http://public.example.com"+tc.path, nil)
+		if rw := route.rewriteFor(matched); rw != nil {
+			if _, ok := rw.rewriteRequest(req, route.Target); !ok {
+				t.Errorf("%s: %s refused the request", tc.path, tc.target)
+				continue
+			}
+		}
+		if req.URL.Path != tc.sent {
+			t.Errorf("%s: %s got %s, want %s", tc.path, tc.target, req.URL.Path, tc.sent)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The WebSocket transport carries the tunnel protocol unchanged as the
+// payload of binary frames (RFC 6455), for networks that only let HTTPS
+// out. Message boundaries carry no meaning, except that an empty binary
+// message ends the sender's direction, like a TCP half-close; the Close
+// handshake is only used to end the connection.
+const (
+	wsGUID     = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsProtocol = "ssl-tunnel"
+
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// dialWebSocket upgrades conn, already connected to the relay, to a
+// WebSocket for path.
+func dialWebSocket(conn net.Conn, host, path string) (net.Conn, error) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Protocol: " + wsProtocol + "\r\n\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, fmt.Errorf("WebSocket upgrade failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("WebSocket upgrade refused: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return nil, fmt.Errorf("WebSocket upgrade failed: invalid Sec-WebSocket-Accept")
+	}
+	return &wsConn{Conn: conn, r: reader, client: true}, nil
+}
+
+// acceptWebSocket answers the upgrade request waiting in reader and returns
+// the WebSocket stream. Other HTTP requests get an error response.
+func acceptWebSocket(conn net.Conn, reader *bufio.Reader) (net.Conn, error) {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP request: %v", err)
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") || key == "" {
+		io.WriteString(conn, "HTTP/1.1 426 Upgrade Required\r\nUpgrade: websocket\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		return nil, fmt.Errorf("%s %s is not a WebSocket upgrade", req.Method, req.URL.Path)
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n"
+	if strings.Contains(req.Header.Get("Sec-WebSocket-Protocol"), wsProtocol) {
+		resp += "Sec-WebSocket-Protocol: " + wsProtocol + "\r\n"
+	}
+	if _, err := io.WriteString(conn, resp+"\r\n"); err != nil {
+		return nil, err
+	}
+	return &wsConn{Conn: conn, r: reader}, nil
+}
+
+// wsConn is a byte stream over WebSocket frames. Frames from the client are
+// masked as the RFC requires. CloseWrite sends an empty binary message,
+// after which the peer reads EOF while it may still send. A Close frame
+// from the peer is answered with one and ends both directions.
+type wsConn struct {
+	net.Conn
+	r      io.Reader
+	client bool
+
+	wmu        sync.Mutex
+	writeEnded bool
+	closeSent  bool
+
+	remaining int64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+	eof       bool
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if err := c.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= int64(n)
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *wsConn) unmask(p []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range p {
+		p[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+// readHeader reads the next frame header; control frames are handled here
+// and leave remaining at 0.
+func (c *wsConn) readHeader() error {
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	c.masked = header[1]&0x80 != 0
+	size := int64(header[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		size = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		size = int64(binary.BigEndian.Uint64(ext[:]) & (1<<63 - 1))
+	}
+	if c.masked {
+		if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+			return err
+		}
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case wsContinuation, wsText, wsBinary:
+		if opcode == wsBinary && fin && size == 0 {
+			c.eof = true
+		}
+		c.remaining = size
+		return nil
+	case wsClose, wsPing, wsPong:
+		if size > 125 {
+			return fmt.Errorf("WebSocket control frame too large (%d bytes)", size)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil && err != net.ErrClosed {
+				return err
+			}
+		case wsClose:
+			// Echo the status code, as RFC 6455 section 5.5.1 asks
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			if err := c.writeFrame(wsClose, payload); err != nil && err != net.ErrClosed {
+				return err
+			}
+			c.eof = true
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid WebSocket opcode %d", opcode)
+	}
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|opcode)
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		buf = append(buf, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(payload)))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(len(payload)))
+	}
+	if c.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		buf = append(buf, mask[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		for i := range payload {
+			buf[start+i] ^= mask[i&3]
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent || (c.writeEnded && opcode == wsBinary) {
+		return net.ErrClosed
+	}
+	switch {
+	case opcode == wsClose:
+		c.closeSent = true
+	case len(payload) == 0:
+		c.writeEnded = true
+	}
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		// An empty message would end the stream
+		return 0, nil
+	}
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// CloseWrite ends this direction with an empty binary message.
+func (c *wsConn) CloseWrite() error {
+	err := c.writeFrame(wsBinary, nil)
+	if err == net.ErrClosed {
+		return nil
+	}
+	return err
+}
+
+// Close sends a Close frame with status 1000, unless one was already sent
+// in answer to the peer's, and closes the connection.
+func (c *wsConn) Close() error {
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrame(wsClose, []byte{0x03, 0xE8})
+	return c.Conn.Close()
+}
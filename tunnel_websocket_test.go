@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+// readRawFrame reads one frame off the wire and returns its first header
+// byte, whether it was masked and the unmasked payload, checking that the
+// length uses the shortest encoding.
+func readRawFrame(t *testing.T, r io.Reader) (byte, bool, []byte) {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	masked := header[1]&0x80 != 0
+	size := uint64(header[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+		if size < 126 {
+			t.Errorf("%d bytes sent with a 16-bit length", size)
+		}
+	case 127:
+		var ext [8]byte
+		io.ReadFull(r, ext[:])
+		size = binary.BigEndian.Uint64(ext[:])
+		if size <= 0xFFFF {
+			t.Errorf("%d bytes sent with a 64-bit length", size)
+		}
+	}
+	var mask [4]byte
+	if masked {
+		io.ReadFull(r, mask[:])
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	for i := range payload {
+		payload[i] ^= mask[i&3]
+	}
+	return header[0], masked, payload
+}
+
+// TestWebSocketFraming sends messages around the 7-bit, 16-bit and 64-bit
+// length limits both ways, checks masking on the wire and reads them back.
+func TestWebSocketFraming(t *testing.T) {
+	for _, client := range []bool{true, false} {
+		for _, size := range []int{1, 125, 126, 0xFFFF, 0x10000, 70000} {
+			a, b := tcpPair(t)
+			b.SetDeadline(time.Now().Add(10 * time.Second))
+			data := make([]byte, size)
+			for i := range data {
+				data[i] = byte(i * 7)
+			}
+			w := &wsConn{Conn: a, client: client}
+			go w.Write(data)
+
+			var raw bytes.Buffer
+			first, masked, payload := readRawFrame(t, io.TeeReader(b, &raw))
+			if first != 0x80|wsBinary || masked != client || !bytes.Equal(payload, data) {
+				t.Fatalf("client %v, %d bytes: header %#x masked %v, payload intact %v", client, size, first, masked, bytes.Equal(payload, data))
+			}
+
+			r := &wsConn{Conn: b, r: &raw, client: !client}
+			got := make([]byte, size)
+			if _, err := io.ReadFull(r, got); err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("client %v, %d bytes: read back %v, intact %v", client, size, err, bytes.Equal(got, data))
+			}
+		}
+	}
+}
+
+// TestWebSocketPing checks that a ping between data frames is answered with
+// a pong carrying its payload and does not show up in the stream.
+func TestWebSocketPing(t *testing.T) {
+	a, b := tcpPair(t)
+	a.SetDeadline(time.Now().Add(10 * time.Second))
+	client := &wsConn{Conn: a, r: bufio.NewReader(a), client: true}
+	server := &wsConn{Conn: b, r: bufio.NewReader(b)}
+
+	client.writeFrame(wsPing, []byte("hi"))
+	client.Write([]byte("data"))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(server, got); err != nil || string(got) != "data" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+	first, masked, payload := readRawFrame(t, a)
+	if first != 0x80|wsPong || masked || string(payload) != "hi" {
+		t.Fatalf("answer %#x masked %v payload %q, want an unmasked pong with hi", first, masked, payload)
+	}
+}
+
+// TestWebSocketHalfClose checks that CloseWrite only ends one direction
+// without a Close frame, and that a Close frame is echoed.
+func TestWebSocketHalfClose(t *testing.T) {
+	a, b := tcpPair(t)
+	deadline := time.Now().Add(10 * time.Second)
+	a.SetDeadline(deadline)
+	b.SetDeadline(deadline)
+	client := &wsConn{Conn: a, r: bufio.NewReader(a), client: true}
+	server := &wsConn{Conn: b, r: bufio.NewReader(b)}
+
+	client.Write([]byte("request"))
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("more")); err == nil {
+		t.Error("write after CloseWrite succeeded")
+	}
+	got, err := io.ReadAll(server)
+	if err != nil || string(got) != "request" {
+		t.Fatalf("server read %q, %v", got, err)
+	}
+
+	// The server may still answer
+	if _, err := server.Write([]byte("reply")); err != nil {
+		t.Fatalf("server write after the client's half-close: %v", err)
+	}
+	got = make([]byte, 5)
+	if _, err := io.ReadFull(client, got); err != nil || string(got) != "reply" {
+		t.Fatalf("client read %q, %v", got, err)
+	}
+
+	server.writeFrame(wsClose, []byte{0x03, 0xE8, 'b', 'y', 'e'})
+	if rest, err := io.ReadAll(client); err != nil || len(rest) > 0 {
+		t.Fatalf("client read %q, %v after the Close frame", rest, err)
+	}
+	first, masked, payload := readRawFrame(t, server.r)
+	if first != 0x80|wsClose || !masked || !bytes.Equal(payload, []byte{0x03, 0xE8}) {
+		t.Fatalf("echo %#x masked %v payload %x, want a masked Close with 1000", first, masked, payload)
+	}
+	if _, err := client.Write([]byte("late")); err == nil {
+		t.Error("write after the Close handshake succeeded")
+	}
+}